@@ -0,0 +1,114 @@
+package candy
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Denial{})
+	})
+}
+
+const (
+	PENDING = "pending"
+	DENIED  = "denied"
+)
+
+// Denial refuses a vmac. It is kept apart from the device, like a ban, so that
+// deleting the device does not let it in again. The status of the device only
+// shows the denial on the device page.
+type Denial struct {
+	Domain    string `gorm:"primaryKey"`
+	VMac      string `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+// checkApproval loads the approval status of a device that just sent its
+// vmac. Unknown devices are queued for approval when the domain requires it.
+func checkApproval(device *Device, approval bool) error {
+	record := &Device{Domain: device.Domain, VMac: device.VMac}
+	result := storage.Find(record)
+
+	if storage.Find(&Denial{Domain: device.Domain, VMac: device.VMac}).RowsAffected != 0 {
+		// a deleted device shows up again, so that it can be approved
+		if result.RowsAffected == 0 {
+			record.Status = DENIED
+			record.ConnUpdatedAt = time.Now()
+			storage.Create(record)
+		}
+		return reject(REFUSED, errors.New("device is denied: "+device.VMac))
+	}
+
+	if result.RowsAffected == 0 && approval {
+		record.Status = PENDING
+		record.ConnUpdatedAt = time.Now()
+		storage.Create(record)
+	}
+
+	device.Status = record.Status
+	return nil
+}
+
+// UpdateDeviceStatus approves or denies a device. Live connections are closed
+// so that the device reconnects with its new status.
+func UpdateDeviceStatus(name, vmac, status string) error {
+	denial := &Denial{Domain: name, VMac: vmac, CreatedAt: time.Now()}
+	if status == DENIED {
+		if result := storage.Save(denial); result.Error != nil {
+			return result.Error
+		}
+	} else if result := storage.Delete(denial); result.Error != nil {
+		return result.Error
+	}
+
+	result := storage.Model(&Device{Domain: name, VMac: vmac}).Update("status", status)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	// the clients are told after the lock is released, since writing to them
+	// may block
+	var denied []*Websocket
+	nameDomainMapMutex.RLock()
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		for ws, device := range domain.wsDeviceMap {
+			if device.VMac == vmac {
+				device.Status = status
+				if status == DENIED {
+					denied = append(denied, ws)
+				} else {
+					ws.closeFor(KICKED)
+				}
+			}
+		}
+		domain.mutex.Unlock()
+	}
+	nameDomainMapMutex.RUnlock()
+
+	for _, ws := range denied {
+		ws.Reject(REFUSED, "device is denied: "+vmac)
+		ws.closeFor(KICKED)
+	}
+	return nil
+}
+
+func UpdateApproval(name string, approval bool) error {
+	if result := storage.Model(&Domain{Name: name}).Update("approval", approval); result.Error != nil {
+		return result.Error
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		domain.Approval = approval
+	}
+	return nil
+}
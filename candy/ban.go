@@ -0,0 +1,122 @@
+package candy
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Ban{})
+	})
+}
+
+// Ban blocks a vmac from joining the domain. A zero ExpiresAt never expires.
+type Ban struct {
+	Domain    string `gorm:"primaryKey"`
+	VMac      string `gorm:"primaryKey"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func checkBan(domain *Domain, vmac string) error {
+	ban := &Ban{Domain: domain.Name, VMac: vmac}
+	if result := storage.Find(ban); result.RowsAffected == 0 {
+		return nil
+	}
+	if !ban.ExpiresAt.IsZero() && time.Now().After(ban.ExpiresAt) {
+		storage.Delete(ban)
+		return nil
+	}
+	return reject(BANNED, errors.New("device is banned: "+vmac))
+}
+
+// DisconnectDevice closes the live connections of vmac.
+func DisconnectDevice(name, vmac string) {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.RLock()
+		defer domain.mutex.RUnlock()
+
+		for ws, device := range domain.wsDeviceMap {
+			if device.VMac == vmac {
+				ws.closeFor(KICKED)
+			}
+		}
+	}
+}
+
+// DeleteDevice closes the live connections of vmac and deletes the device. The
+// devices of those connections are marked deleted first, so that neither their
+// disconnect nor a concurrent Sync saves them again.
+func DeleteDevice(name, vmac string) {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	nameDomainMapMutex.RLock()
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		for ws, device := range domain.wsDeviceMap {
+			if device.VMac == vmac {
+				device.deleted = true
+				ws.closeFor(KICKED)
+			}
+		}
+		domain.mutex.Unlock()
+	}
+	nameDomainMapMutex.RUnlock()
+
+	dirtyDevices.mutex.Lock()
+	for device := range dirtyDevices.m {
+		if device.Domain == name && device.VMac == vmac {
+			delete(dirtyDevices.m, device)
+		}
+	}
+	dirtyDevices.mutex.Unlock()
+
+	storage.Delete(&Device{Domain: name, VMac: vmac})
+}
+
+func BanDevice(name, vmac string, duration time.Duration) error {
+	if _, err := strconv.ParseUint(vmac, 16, 64); err != nil || len(vmac) != 16 {
+		return errors.New("invalid ban vmac: " + vmac)
+	}
+
+	ban := &Ban{Domain: name, VMac: vmac, CreatedAt: time.Now()}
+	if duration > 0 {
+		ban.ExpiresAt = ban.CreatedAt.Add(duration)
+	}
+	if result := storage.Save(ban); result.Error != nil {
+		return result.Error
+	}
+
+	// the clients are told after the lock is released, since writing to them
+	// may block
+	var banned []*Websocket
+	nameDomainMapMutex.RLock()
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.RLock()
+		for ws, device := range domain.wsDeviceMap {
+			if device.VMac == vmac {
+				banned = append(banned, ws)
+			}
+		}
+		domain.mutex.RUnlock()
+	}
+	nameDomainMapMutex.RUnlock()
+
+	for _, ws := range banned {
+		ws.Reject(BANNED, "device is banned: "+vmac)
+		ws.conn.Close()
+	}
+	return nil
+}
+
+func UnbanDevice(name, vmac string) {
+	storage.Delete(&Ban{Domain: name, VMac: vmac})
+}
@@ -0,0 +1,263 @@
+package candy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Bridge{})
+	})
+}
+
+// Bridge links two domains. DomainMap is the network under which the devices
+// of Domain are visible inside Peer and PeerMap is the network under which the
+// devices of Peer are visible inside Domain. An empty map keeps the original
+// network, which only works when the two networks do not overlap.
+type Bridge struct {
+	ID        uint `gorm:"primaryKey"`
+	Domain    string
+	Peer      string
+	DomainMap string
+	PeerMap   string
+}
+
+type bridge struct {
+	peer string
+
+	// the peer network as addressed from this domain
+	remoteNetID uint32
+	remoteMask  uint32
+
+	// this network as addressed from the peer
+	localNetID uint32
+}
+
+func parseNetwork(name string) (netID, mask uint32, err error) {
+	domain := &Domain{}
+	if result := storage.Where("name = ?", name).Take(domain); result.Error != nil {
+		return 0, 0, errors.New("invalid bridge domain: " + name)
+	}
+	_, ipNet, err := net.ParseCIDR(domain.DHCP)
+	if err != nil || ipNet.IP.To4() == nil {
+		return 0, 0, errors.New("bridge domain has no network: " + name)
+	}
+	return binary.BigEndian.Uint32(ipNet.IP.To4()), binary.BigEndian.Uint32(ipNet.Mask), nil
+}
+
+func parseMap(input string, netID, mask uint32) (uint32, error) {
+	if input == "" {
+		return netID, nil
+	}
+	_, ipNet, err := net.ParseCIDR(input)
+	if err != nil || ipNet.IP.To4() == nil || binary.BigEndian.Uint32(ipNet.Mask) != mask {
+		return 0, errors.New("invalid bridge map: " + input)
+	}
+	return binary.BigEndian.Uint32(ipNet.IP.To4()), nil
+}
+
+// parseBridge returns the bridge as seen from the side named local.
+func parseBridge(record *Bridge, local string) (bridge, error) {
+	domainNetID, domainMask, err := parseNetwork(record.Domain)
+	if err != nil {
+		return bridge{}, err
+	}
+	peerNetID, peerMask, err := parseNetwork(record.Peer)
+	if err != nil {
+		return bridge{}, err
+	}
+	domainMap, err := parseMap(record.DomainMap, domainNetID, domainMask)
+	if err != nil {
+		return bridge{}, err
+	}
+	peerMap, err := parseMap(record.PeerMap, peerNetID, peerMask)
+	if err != nil {
+		return bridge{}, err
+	}
+
+	if local == record.Domain {
+		return bridge{peer: record.Peer, remoteNetID: peerMap, remoteMask: peerMask, localNetID: domainMap}, nil
+	}
+	return bridge{peer: record.Domain, remoteNetID: domainMap, remoteMask: domainMask, localNetID: peerMap}, nil
+}
+
+func overlaps(netID, mask, otherNetID, otherMask uint32) bool {
+	common := mask & otherMask
+	return netID&common == otherNetID&common
+}
+
+// CheckBridge validates a bridge against the stored networks of both domains.
+// Each side must see the other under a network that does not overlap its own.
+func CheckBridge(r *Bridge) error {
+	if r.Domain == r.Peer {
+		return errors.New("domain cannot be bridged to itself")
+	}
+	b, err := parseBridge(r, r.Domain)
+	if err != nil {
+		return err
+	}
+
+	netID, mask, err := parseNetwork(r.Domain)
+	if err != nil {
+		return err
+	}
+	peerNetID, peerMask, err := parseNetwork(r.Peer)
+	if err != nil {
+		return err
+	}
+	if overlaps(b.remoteNetID, b.remoteMask, netID, mask) {
+		return errors.New("peer network overlaps " + r.Domain + " and needs a map")
+	}
+	if overlaps(b.localNetID, mask, peerNetID, peerMask) {
+		return errors.New("domain network overlaps " + r.Peer + " and needs a map")
+	}
+	return nil
+}
+
+func loadBridges(domain *Domain) {
+	var records []Bridge
+	storage.Where("domain = ? OR peer = ?", domain.Name, domain.Name).Find(&records)
+
+	domain.bridges = nil
+	for idx := range records {
+		b, err := parseBridge(&records[idx], domain.Name)
+		if err != nil {
+			logger.Debug(err)
+			continue
+		}
+		domain.bridges = append(domain.bridges, b)
+	}
+}
+
+func ReloadBridges(names ...string) {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	for _, name := range names {
+		if domain, ok := nameDomainMap[name]; ok {
+			domain.mutex.Lock()
+			loadBridges(domain)
+			domain.mutex.Unlock()
+		}
+	}
+}
+
+func lookupBridge(domain *Domain, ip uint32) *bridge {
+	for idx := range domain.bridges {
+		b := &domain.bridges[idx]
+		if ip&b.remoteMask == b.remoteNetID {
+			return b
+		}
+	}
+	return nil
+}
+
+// forwardBridge translates a frame addressed to a bridged network and hands
+// it to the peer domain. It runs after the lock of the source domain has been
+// released and takes the locks of both domains in the order of their names,
+// so that relays in opposite directions cannot deadlock.
+func forwardBridge(domain *Domain, device *Device, b bridge, buffer []byte, src, dst uint32) bool {
+	if src&domain.mask != domain.netID {
+		return false
+	}
+
+	nameDomainMapMutex.RLock()
+	peer, ok := nameDomainMap[b.peer]
+	nameDomainMapMutex.RUnlock()
+	if !ok {
+		metrics.bridgeDropped.Add(1)
+		return false
+	}
+
+	first, second := domain, peer
+	if peer.Name < domain.Name {
+		first, second = peer, domain
+	}
+	first.mutex.RLock()
+	defer first.mutex.RUnlock()
+	second.mutex.RLock()
+	defer second.mutex.RUnlock()
+
+	newSrc := b.localNetID | src&^domain.mask
+	newDst := peer.netID | dst&^b.remoteMask
+
+	dstWs, ok := peer.ipWsMap[newDst]
+	if !ok {
+		metrics.bridgeDropped.Add(1)
+		return false
+	}
+	dstDev := peer.wsDeviceMap[dstWs]
+	if !isAllowed(domain, device, src, dstDev, dst) || !isAllowed(peer, device, newSrc, dstDev, newDst) {
+		return false
+	}
+
+	if dstWs.WriteMessage(rewriteIPv4(buffer, newSrc, newDst)) == nil {
+		dstDev.RX += uint64(len(buffer))
+		observe(domain, device, nil, buffer)
+	}
+	return true
+}
+
+// checksumAdjust incrementally updates a one's complement checksum after a
+// 32-bit field changed from old to new, as described in RFC 1624.
+func checksumAdjust(checksum uint16, old, new uint32) uint16 {
+	sum := uint32(^checksum)
+	sum += uint32(^uint16(old>>16)) + uint32(^uint16(old))
+	sum += new>>16 + new&0xFFFF
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
+
+// rewriteIPv4 returns a copy of a FORWARD frame with new addresses, fixing the
+// IPv4 header checksum and the TCP or UDP checksum covering the pseudo header.
+func rewriteIPv4(buffer []byte, src, dst uint32) []byte {
+	output := make([]byte, len(buffer))
+	copy(output, buffer)
+
+	packet := output[1:]
+	ihl := int(packet[0]&0x0F) * 4
+	if ihl < 20 || len(packet) < ihl {
+		return output
+	}
+
+	oldSrc := binary.BigEndian.Uint32(packet[12:16])
+	oldDst := binary.BigEndian.Uint32(packet[16:20])
+	binary.BigEndian.PutUint32(packet[12:16], src)
+	binary.BigEndian.PutUint32(packet[16:20], dst)
+
+	adjust := func(offset int) {
+		checksum := binary.BigEndian.Uint16(packet[offset:])
+		checksum = checksumAdjust(checksum, oldSrc, src)
+		checksum = checksumAdjust(checksum, oldDst, dst)
+		binary.BigEndian.PutUint16(packet[offset:], checksum)
+	}
+
+	adjust(10)
+
+	// only the first fragment carries the transport header
+	if binary.BigEndian.Uint16(packet[6:8])&0x1FFF != 0 {
+		return output
+	}
+
+	switch packet[9] {
+	case 6:
+		if len(packet) >= ihl+18 {
+			adjust(ihl + 16)
+		}
+	case 17:
+		if len(packet) >= ihl+8 && binary.BigEndian.Uint16(packet[ihl+6:]) != 0 {
+			adjust(ihl + 6)
+			if binary.BigEndian.Uint16(packet[ihl+6:]) == 0 {
+				binary.BigEndian.PutUint16(packet[ihl+6:], 0xFFFF)
+			}
+		}
+	}
+	return output
+}
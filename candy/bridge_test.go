@@ -0,0 +1,39 @@
+package candy
+
+import (
+	"testing"
+
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func TestCheckBridge(t *testing.T) {
+	for _, domain := range []*Domain{
+		{Name: "bridge-a", DHCP: "10.1.0.0/24"},
+		{Name: "bridge-b", DHCP: "10.2.0.0/24"},
+		{Name: "bridge-c", DHCP: "10.1.0.0/16"},
+	} {
+		if err := storage.Create(domain).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		bridge Bridge
+		ok     bool
+	}{
+		{"disjoint", Bridge{Domain: "bridge-a", Peer: "bridge-b"}, true},
+		{"overlapping", Bridge{Domain: "bridge-a", Peer: "bridge-c"}, false},
+		{"peer mapped only", Bridge{Domain: "bridge-a", Peer: "bridge-c", PeerMap: "10.9.0.0/16"}, false},
+		{"both mapped", Bridge{Domain: "bridge-a", Peer: "bridge-c", DomainMap: "10.8.0.0/24", PeerMap: "10.9.0.0/16"}, true},
+		{"map overlapping the other side", Bridge{Domain: "bridge-a", Peer: "bridge-b", PeerMap: "10.1.0.0/24"}, false},
+		{"unknown peer", Bridge{Domain: "bridge-a", Peer: "bridge-x"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckBridge(&tt.bridge); (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package candy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A capture stops recording once it holds maxCaptureSize bytes, and may not
+// run longer than maxCaptureDuration.
+const (
+	maxCaptureSize     = 64 << 20
+	maxCaptureDuration = time.Hour
+)
+
+// Block types and options of the pcapng format.
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	pcapngOptEnd         = 0
+	pcapngOptComment     = 1
+	pcapngOptIfName      = 2
+
+	// The payload of a FORWARD message is an IP packet without a link layer
+	// header.
+	linktypeRaw = 101
+)
+
+// capture records the packets relayed in a domain, or only those sent to or
+// by one device when vmac is not empty, as pcapng blocks.
+type capture struct {
+	mutex     sync.Mutex
+	vmac      string
+	startedAt time.Time
+	until     time.Time
+	packets   uint64
+	truncated bool
+	blocks    bytes.Buffer
+}
+
+// CaptureStatus describes the capture of a domain.
+type CaptureStatus struct {
+	VMac      string
+	StartedAt time.Time
+	Until     time.Time
+	Running   bool
+	Truncated bool
+	Packets   uint64
+	Size      int
+}
+
+// pcapngBlock encodes a block whose body is followed by the given options.
+func pcapngBlock(blockType uint32, body []byte, options ...[]byte) []byte {
+	var buffer []byte
+	buffer = binary.LittleEndian.AppendUint32(buffer, blockType)
+	buffer = binary.LittleEndian.AppendUint32(buffer, 0)
+	buffer = append(buffer, body...)
+	if len(options) != 0 {
+		for _, option := range options {
+			buffer = append(buffer, option...)
+		}
+		buffer = pcapngOption(buffer, pcapngOptEnd, nil)
+	}
+	length := uint32(len(buffer) + 4)
+	binary.LittleEndian.PutUint32(buffer[4:], length)
+	return binary.LittleEndian.AppendUint32(buffer, length)
+}
+
+// pcapngOption appends an option padded to 32 bits.
+func pcapngOption(buffer []byte, code uint16, value []byte) []byte {
+	buffer = binary.LittleEndian.AppendUint16(buffer, code)
+	buffer = binary.LittleEndian.AppendUint16(buffer, uint16(len(value)))
+	buffer = append(buffer, value...)
+	return append(buffer, make([]byte, (4-len(value)%4)%4)...)
+}
+
+// header returns the section header and the interface description that start
+// the file.
+func (c *capture) header(name string) []byte {
+	var section []byte
+	section = binary.LittleEndian.AppendUint32(section, pcapngByteOrderMagic)
+	section = binary.LittleEndian.AppendUint16(section, 1)
+	section = binary.LittleEndian.AppendUint16(section, 0)
+	section = binary.LittleEndian.AppendUint64(section, ^uint64(0))
+
+	var iface []byte
+	iface = binary.LittleEndian.AppendUint16(iface, linktypeRaw)
+	iface = binary.LittleEndian.AppendUint16(iface, 0)
+	iface = binary.LittleEndian.AppendUint32(iface, 0)
+
+	ifName := name
+	if c.vmac != "" {
+		ifName += "/" + c.vmac
+	}
+
+	buffer := pcapngBlock(pcapngSectionHeader, section)
+	return append(buffer, pcapngBlock(pcapngInterface, iface, pcapngOption(nil, pcapngOptIfName, []byte(ifName)))...)
+}
+
+// record appends the IP packet of a FORWARD message that src delivered to dst.
+// dst is nil when the frame went to several devices, or to another domain.
+func (c *capture) record(src, dst *Device, buffer []byte) {
+	if c.vmac != "" && src.VMac != c.vmac && (dst == nil || dst.VMac != c.vmac) {
+		return
+	}
+
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now.After(c.until) || c.truncated {
+		return
+	}
+
+	packet := buffer[1:]
+	srcIP, dstIP := net.IP(packet[12:16]), net.IP(packet[16:20])
+	if packet[0]>>4 == 6 {
+		srcIP, dstIP = net.IP(packet[8:24]), net.IP(packet[24:40])
+	}
+	comment := fmt.Sprintf("%v (%v) -> %v", srcIP, src.VMac, dstIP)
+	if dst != nil {
+		comment += fmt.Sprintf(" (%v)", dst.VMac)
+	}
+
+	micros := uint64(now.UnixMicro())
+	var body []byte
+	body = binary.LittleEndian.AppendUint32(body, 0)
+	body = binary.LittleEndian.AppendUint32(body, uint32(micros>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(micros))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+	body = append(body, packet...)
+	body = append(body, make([]byte, (4-len(packet)%4)%4)...)
+
+	block := pcapngBlock(pcapngEnhancedPacket, body, pcapngOption(nil, pcapngOptComment, []byte(comment)))
+	if c.blocks.Len()+len(block) > maxCaptureSize {
+		c.truncated = true
+		return
+	}
+	c.blocks.Write(block)
+	c.packets++
+}
+
+// StartCapture replaces the capture of a domain with a new one that runs for
+// duration.
+func StartCapture(name, vmac string, duration time.Duration) error {
+	if duration <= 0 || duration > maxCaptureDuration {
+		return errors.New("invalid capture duration")
+	}
+
+	domain := GetDomain(name)
+	if domain == nil {
+		return errors.New("domain not found")
+	}
+
+	now := time.Now()
+	domain.mutex.Lock()
+	defer domain.mutex.Unlock()
+	domain.capture = &capture{vmac: vmac, startedAt: now, until: now.Add(duration)}
+	return nil
+}
+
+// StopCapture ends the capture of a domain early and keeps what it recorded.
+func StopCapture(name string) {
+	if c := domainCapture(name); c != nil {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if now := time.Now(); now.Before(c.until) {
+			c.until = now
+		}
+	}
+}
+
+func DeleteCapture(name string) {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		domain.capture = nil
+	}
+}
+
+func domainCapture(name string) *capture {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	domain, ok := nameDomainMap[name]
+	if !ok {
+		return nil
+	}
+	domain.mutex.RLock()
+	defer domain.mutex.RUnlock()
+	return domain.capture
+}
+
+// GetCaptureStatus returns the capture of a domain, if it has one.
+func GetCaptureStatus(name string) (CaptureStatus, bool) {
+	c := domainCapture(name)
+	if c == nil {
+		return CaptureStatus{}, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return CaptureStatus{
+		VMac:      c.vmac,
+		StartedAt: c.startedAt,
+		Until:     c.until,
+		Running:   time.Now().Before(c.until) && !c.truncated,
+		Truncated: c.truncated,
+		Packets:   c.packets,
+		Size:      c.blocks.Len(),
+	}, true
+}
+
+// WriteCapture writes the capture of a domain as a pcapng file. Packets that
+// arrive while it is written are left out.
+func WriteCapture(name string, w io.Writer) error {
+	c := domainCapture(name)
+	if c == nil {
+		return errors.New("capture not found")
+	}
+
+	c.mutex.Lock()
+	blocks := c.blocks.Bytes()[:c.blocks.Len():c.blocks.Len()]
+	c.mutex.Unlock()
+
+	if _, err := w.Write(c.header(name)); err != nil {
+		return err
+	}
+	_, err := w.Write(blocks)
+	return err
+}
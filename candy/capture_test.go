@@ -0,0 +1,123 @@
+package candy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+type pcapngTestBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func parsePcapng(t *testing.T, data []byte) []pcapngTestBlock {
+	t.Helper()
+	var blocks []pcapngTestBlock
+	for len(data) != 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %x", data)
+		}
+		blockType := binary.LittleEndian.Uint32(data)
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || length < 12 || int(length) > len(data) {
+			t.Fatalf("invalid block length %v", length)
+		}
+		if trailer := binary.LittleEndian.Uint32(data[length-4:]); trailer != length {
+			t.Fatalf("block length %v does not match trailer %v", length, trailer)
+		}
+		blocks = append(blocks, pcapngTestBlock{blockType, data[8 : length-4]})
+		data = data[length:]
+	}
+	return blocks
+}
+
+// pcapngOptions returns the options that follow a body of size bytes.
+func pcapngOptions(t *testing.T, body []byte, size int) map[uint16]string {
+	t.Helper()
+	options := make(map[uint16]string)
+	for rest := body[size:]; len(rest) >= 4; {
+		code := binary.LittleEndian.Uint16(rest)
+		length := int(binary.LittleEndian.Uint16(rest[2:]))
+		if code == pcapngOptEnd {
+			return options
+		}
+		if len(rest) < 4+length {
+			t.Fatalf("truncated option %v", code)
+		}
+		options[code] = string(rest[4 : 4+length])
+		rest = rest[4+length+(4-length%4)%4:]
+	}
+	t.Fatal("options are not terminated")
+	return nil
+}
+
+func TestCaptureBlocks(t *testing.T) {
+	domain := newTestDomain(t, "10.0.0.0/24", SEQUENTIAL)
+	src, dst := mustIP(t, "10.0.0.1"), mustIP(t, "10.0.0.2")
+	connect(domain, "000000000000000a", src)
+	connect(domain, "000000000000000b", dst)
+	connect(domain, "000000000000000c", mustIP(t, "10.0.0.4"))
+	domain.ipWsMap[dst].queue = make(chan []byte, 1)
+	domain.rules = []rule{{src: endpoint{any: true}, dst: endpoint{vmac: "000000000000000c"}}}
+
+	now := time.Now()
+	c := &capture{startedAt: now, until: now.Add(time.Minute)}
+	domain.capture = c
+
+	frame := func(dst uint32, payload string) []byte {
+		buffer := make([]byte, forwardMessageSize+len(payload))
+		buffer[0] = FORWARD
+		buffer[1] = 0x45
+		binary.BigEndian.PutUint32(buffer[13:], src)
+		binary.BigEndian.PutUint32(buffer[17:], dst)
+		copy(buffer[forwardMessageSize:], payload)
+		return buffer
+	}
+	delivered := frame(dst, "hello")
+	// frames without a receiver or denied by a rule are not recorded
+	for _, buffer := range [][]byte{delivered, frame(mustIP(t, "10.0.0.3"), "nobody"), frame(mustIP(t, "10.0.0.4"), "denied")} {
+		if err := handleForwardMessage(domain.ipWsMap[src], domain, buffer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocks := parsePcapng(t, append(c.header(domain.Name), c.blocks.Bytes()...))
+	if len(blocks) != 3 {
+		t.Fatalf("got %v blocks, want 3", len(blocks))
+	}
+
+	shb, idb, epb := blocks[0], blocks[1], blocks[2]
+	if shb.blockType != pcapngSectionHeader || binary.LittleEndian.Uint32(shb.body) != pcapngByteOrderMagic {
+		t.Errorf("invalid section header: %x", shb.body)
+	}
+
+	if idb.blockType != pcapngInterface || binary.LittleEndian.Uint16(idb.body) != linktypeRaw {
+		t.Errorf("invalid interface description: %x", idb.body)
+	}
+	if name := pcapngOptions(t, idb.body, 8)[pcapngOptIfName]; name != domain.Name {
+		t.Errorf("got interface name %q, want %q", name, domain.Name)
+	}
+
+	if epb.blockType != pcapngEnhancedPacket {
+		t.Fatalf("got block type %x, want an enhanced packet", epb.blockType)
+	}
+	packet := delivered[1:]
+	captured := binary.LittleEndian.Uint32(epb.body[12:])
+	original := binary.LittleEndian.Uint32(epb.body[16:])
+	if captured != uint32(len(packet)) || original != uint32(len(packet)) {
+		t.Errorf("got lengths %v/%v, want %v", captured, original, len(packet))
+	}
+	if !bytes.Equal(epb.body[20:20+len(packet)], packet) {
+		t.Errorf("got packet %x, want %x", epb.body[20:20+len(packet)], packet)
+	}
+	micros := int64(binary.LittleEndian.Uint32(epb.body[4:]))<<32 | int64(binary.LittleEndian.Uint32(epb.body[8:]))
+	if at := time.UnixMicro(micros); at.Before(now.Truncate(time.Microsecond)) || at.After(time.Now()) {
+		t.Errorf("got timestamp %v, want one after %v", at, now)
+	}
+	comment := pcapngOptions(t, epb.body, 20+len(packet)+(4-len(packet)%4)%4)[pcapngOptComment]
+	if want := "10.0.0.1 (000000000000000a) -> 10.0.0.2 (000000000000000b)"; comment != want {
+		t.Errorf("got comment %q, want %q", comment, want)
+	}
+}
@@ -0,0 +1,284 @@
+package candy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Hand-written codecs for the messages in message.go. Fields are packed in
+// declaration order, big endian and without padding, which is the layout the
+// struc based codecs used before; codec_test.go pins it. Avoiding reflection
+// keeps the relay path free of allocations.
+
+var errShortMessage = errors.New("message is too short")
+
+// nulTerminated returns the string in a fixed size field, which is padded with
+// zeros unless the string fills the whole field.
+func nulTerminated(field []byte) string {
+	if idx := bytes.IndexByte(field, 0); idx != -1 {
+		field = field[:idx]
+	}
+	return string(field)
+}
+
+const (
+	authMessageSize      = 1 + 4 + 8 + 32
+	forwardMessageSize   = 1 + 12 + 4 + 4
+	forward6MessageSize  = 1 + 8 + 16 + 16
+	dhcpMessageSize      = 1 + 8 + 32 + 32
+	peerConnMessageSize  = 1 + 4 + 4 + 4 + 2
+	vmacMessageSize      = 1 + 16 + 8 + 32
+	discoveryMessageSize = 1 + 4 + 4
+	generalMessageSize   = 1 + 1 + 2 + 4 + 4
+	routeEntrySize       = 4 + 4 + 4
+	auth6MessageSize     = 1 + 16 + 8 + 32
+	dhcp6MessageSize     = 1 + 8 + 64 + 32
+)
+
+func (m *AuthMessage) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < authMessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	m.IP = binary.BigEndian.Uint32(buffer[1:])
+	m.Timestamp = int64(binary.BigEndian.Uint64(buffer[5:]))
+	copy(m.Hash[:], buffer[13:45])
+	return nil
+}
+
+func (m *AuthMessage) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, authMessageSize)
+	buffer[0] = m.Type
+	binary.BigEndian.PutUint32(buffer[1:], m.IP)
+	binary.BigEndian.PutUint64(buffer[5:], uint64(m.Timestamp))
+	copy(buffer[13:], m.Hash[:])
+	return buffer, nil
+}
+
+func (m *ForwardMessage) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < forwardMessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	copy(m.Unused[:], buffer[1:13])
+	m.Src = binary.BigEndian.Uint32(buffer[13:])
+	m.Dst = binary.BigEndian.Uint32(buffer[17:])
+	return nil
+}
+
+func (m *ForwardMessage) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, forwardMessageSize)
+	buffer[0] = m.Type
+	copy(buffer[1:], m.Unused[:])
+	binary.BigEndian.PutUint32(buffer[13:], m.Src)
+	binary.BigEndian.PutUint32(buffer[17:], m.Dst)
+	return buffer, nil
+}
+
+func (m *Forward6Message) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < forward6MessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	copy(m.Unused[:], buffer[1:9])
+	copy(m.Src[:], buffer[9:25])
+	copy(m.Dst[:], buffer[25:41])
+	return nil
+}
+
+func (m *Forward6Message) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, forward6MessageSize)
+	buffer[0] = m.Type
+	copy(buffer[1:], m.Unused[:])
+	copy(buffer[9:], m.Src[:])
+	copy(buffer[25:], m.Dst[:])
+	return buffer, nil
+}
+
+func (m *DHCPMessage) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < dhcpMessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	m.Timestamp = int64(binary.BigEndian.Uint64(buffer[1:]))
+	m.Cidr = append([]byte(nil), buffer[9:41]...)
+	copy(m.Hash[:], buffer[41:73])
+	return nil
+}
+
+func (m *DHCPMessage) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, dhcpMessageSize)
+	buffer[0] = m.Type
+	binary.BigEndian.PutUint64(buffer[1:], uint64(m.Timestamp))
+	copy(buffer[9:41], m.Cidr)
+	copy(buffer[41:], m.Hash[:])
+	return buffer, nil
+}
+
+func (m *PeerConnMessage) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < peerConnMessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	m.Src = binary.BigEndian.Uint32(buffer[1:])
+	m.Dst = binary.BigEndian.Uint32(buffer[5:])
+	m.IP = binary.BigEndian.Uint32(buffer[9:])
+	m.Port = binary.BigEndian.Uint16(buffer[13:])
+	return nil
+}
+
+func (m *PeerConnMessage) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, peerConnMessageSize)
+	buffer[0] = m.Type
+	binary.BigEndian.PutUint32(buffer[1:], m.Src)
+	binary.BigEndian.PutUint32(buffer[5:], m.Dst)
+	binary.BigEndian.PutUint32(buffer[9:], m.IP)
+	binary.BigEndian.PutUint16(buffer[13:], m.Port)
+	return buffer, nil
+}
+
+func (m *VMacMessage) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < vmacMessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	m.VMac = string(buffer[1:17])
+	m.Timestamp = int64(binary.BigEndian.Uint64(buffer[17:]))
+	copy(m.Hash[:], buffer[25:57])
+	return nil
+}
+
+func (m *VMacMessage) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, vmacMessageSize)
+	buffer[0] = m.Type
+	copy(buffer[1:17], m.VMac)
+	binary.BigEndian.PutUint64(buffer[17:], uint64(m.Timestamp))
+	copy(buffer[25:], m.Hash[:])
+	return buffer, nil
+}
+
+func (m *DiscoveryMessage) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < discoveryMessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	m.Src = binary.BigEndian.Uint32(buffer[1:])
+	m.Dst = binary.BigEndian.Uint32(buffer[5:])
+	return nil
+}
+
+func (m *DiscoveryMessage) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, discoveryMessageSize)
+	buffer[0] = m.Type
+	binary.BigEndian.PutUint32(buffer[1:], m.Src)
+	binary.BigEndian.PutUint32(buffer[5:], m.Dst)
+	return buffer, nil
+}
+
+func (m *GeneralMessage) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < generalMessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	m.Subtype = buffer[1]
+	m.Extra = binary.BigEndian.Uint16(buffer[2:])
+	m.Src = binary.BigEndian.Uint32(buffer[4:])
+	m.Dst = binary.BigEndian.Uint32(buffer[8:])
+	return nil
+}
+
+func (m *GeneralMessage) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, generalMessageSize)
+	buffer[0] = m.Type
+	buffer[1] = m.Subtype
+	binary.BigEndian.PutUint16(buffer[2:], m.Extra)
+	binary.BigEndian.PutUint32(buffer[4:], m.Src)
+	binary.BigEndian.PutUint32(buffer[8:], m.Dst)
+	return buffer, nil
+}
+
+// UnmarshalBinary reads as many entries as Size announces. The Size field of a
+// decoded message always matches its entries.
+func (m *RouteMessage) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < generalMessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	m.Subtype = buffer[1]
+	m.Size = binary.BigEndian.Uint16(buffer[2:])
+	m.Src = binary.BigEndian.Uint32(buffer[4:])
+	m.Dst = binary.BigEndian.Uint32(buffer[8:])
+
+	if len(buffer) < generalMessageSize+int(m.Size)*routeEntrySize {
+		return errShortMessage
+	}
+	m.Entries = make([]RouteEntry, m.Size)
+	for idx := range m.Entries {
+		entry := buffer[generalMessageSize+idx*routeEntrySize:]
+		m.Entries[idx].Gateway = binary.BigEndian.Uint32(entry[0:])
+		m.Entries[idx].NetID = binary.BigEndian.Uint32(entry[4:])
+		m.Entries[idx].Mask = binary.BigEndian.Uint32(entry[8:])
+	}
+	return nil
+}
+
+// MarshalBinary derives Size from the entries, as the sizeof tag does.
+func (m *RouteMessage) MarshalBinary() ([]byte, error) {
+	if len(m.Entries) > 0xFFFF {
+		return nil, errors.New("too many route entries")
+	}
+	buffer := make([]byte, generalMessageSize+len(m.Entries)*routeEntrySize)
+	buffer[0] = m.Type
+	buffer[1] = m.Subtype
+	binary.BigEndian.PutUint16(buffer[2:], uint16(len(m.Entries)))
+	binary.BigEndian.PutUint32(buffer[4:], m.Src)
+	binary.BigEndian.PutUint32(buffer[8:], m.Dst)
+	for idx := range m.Entries {
+		entry := buffer[generalMessageSize+idx*routeEntrySize:]
+		binary.BigEndian.PutUint32(entry[0:], m.Entries[idx].Gateway)
+		binary.BigEndian.PutUint32(entry[4:], m.Entries[idx].NetID)
+		binary.BigEndian.PutUint32(entry[8:], m.Entries[idx].Mask)
+	}
+	return buffer, nil
+}
+
+func (m *Auth6Message) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < auth6MessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	copy(m.IP[:], buffer[1:17])
+	m.Timestamp = int64(binary.BigEndian.Uint64(buffer[17:]))
+	copy(m.Hash[:], buffer[25:57])
+	return nil
+}
+
+func (m *Auth6Message) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, auth6MessageSize)
+	buffer[0] = m.Type
+	copy(buffer[1:], m.IP[:])
+	binary.BigEndian.PutUint64(buffer[17:], uint64(m.Timestamp))
+	copy(buffer[25:], m.Hash[:])
+	return buffer, nil
+}
+
+func (m *DHCP6Message) UnmarshalBinary(buffer []byte) error {
+	if len(buffer) < dhcp6MessageSize {
+		return errShortMessage
+	}
+	m.Type = buffer[0]
+	m.Timestamp = int64(binary.BigEndian.Uint64(buffer[1:]))
+	m.Cidr = append([]byte(nil), buffer[9:73]...)
+	copy(m.Hash[:], buffer[73:105])
+	return nil
+}
+
+func (m *DHCP6Message) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, dhcp6MessageSize)
+	buffer[0] = m.Type
+	binary.BigEndian.PutUint64(buffer[1:], uint64(m.Timestamp))
+	copy(buffer[9:73], m.Cidr)
+	copy(buffer[73:], m.Hash[:])
+	return buffer, nil
+}
@@ -0,0 +1,118 @@
+package candy
+
+import (
+	"encoding"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+type message interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+func sequence(first byte, n int) []byte {
+	buffer := make([]byte, n)
+	for i := range buffer {
+		buffer[i] = first + byte(i)
+	}
+	return buffer
+}
+
+func hash32(first byte) (hash [32]byte) {
+	copy(hash[:], sequence(first, 32))
+	return
+}
+
+func ip16(first byte) (ip [16]byte) {
+	copy(ip[:], sequence(first, 16))
+	return
+}
+
+func cidr(input string, size int) []byte {
+	buffer := make([]byte, size)
+	copy(buffer, input)
+	return buffer
+}
+
+// The golden bytes were produced by the struc tags these messages were
+// declared with before the codecs in codec.go replaced them.
+func TestMessageCodecs(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  message
+		output message
+		golden string
+	}{
+		{"auth", &AuthMessage{Type: AUTH, IP: 0x0a040001, Timestamp: 1700000000, Hash: hash32(0x10)}, &AuthMessage{},
+			"000a040001000000006553f100101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f"},
+		{"forward", &ForwardMessage{Type: FORWARD, Unused: [12]byte{0x45, 0, 0, 0x15}, Src: 0x0a040001, Dst: 0x0a040002}, &ForwardMessage{},
+			"014500001500000000000000000a0400010a040002"},
+		{"forward6", &Forward6Message{Type: FORWARD, Unused: [8]byte{0x60}, Src: ip16(0xf0), Dst: ip16(0xa0)}, &Forward6Message{},
+			"016000000000000000f0f1f2f3f4f5f6f7f8f9fafbfcfdfeffa0a1a2a3a4a5a6a7a8a9aaabacadaeaf"},
+		{"dhcp", &DHCPMessage{Type: DHCP, Timestamp: 1700000000, Cidr: cidr("10.4.0.1/24", 32), Hash: hash32(0x20)}, &DHCPMessage{},
+			"02000000006553f10031302e342e302e312f3234000000000000000000000000000000000000000000202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"},
+		{"peer", &PeerConnMessage{Type: PEER, Src: 0x0a040001, Dst: 0x0a040002, IP: 0xc0a80101, Port: 51820}, &PeerConnMessage{},
+			"030a0400010a040002c0a80101ca6c"},
+		{"vmac", &VMacMessage{Type: VMAC, VMac: "0123456789abcdef", Timestamp: 1700000000, Hash: hash32(0x30)}, &VMacMessage{},
+			"0430313233343536373839616263646566000000006553f100303132333435363738393a3b3c3d3e3f404142434445464748494a4b4c4d4e4f"},
+		{"discovery", &DiscoveryMessage{Type: DISCOVERY, Src: 0x0a040001, Dst: 0xffffffff}, &DiscoveryMessage{},
+			"050a040001ffffffff"},
+		{"general", &GeneralMessage{Type: GENERAL, Subtype: NOTICE, Extra: 0x0102, Src: 0x0a040001, Dst: 0x0a040002}, &GeneralMessage{},
+			"ff1201020a0400010a040002"},
+		{"route", &RouteMessage{Type: GENERAL, Subtype: ROUTE, Size: 2, Dst: 0x0a040002, Entries: []RouteEntry{
+			{Gateway: 0x0a040001, NetID: 0xc0a80100, Mask: 0xffffff00},
+			{Gateway: 0x0a040003},
+		}}, &RouteMessage{},
+			"ff110002000000000a0400020a040001c0a80100ffffff000a0400030000000000000000"},
+		{"auth6", &Auth6Message{Type: AUTH6, IP: ip16(0xfd), Timestamp: 1700000000, Hash: hash32(0x40)}, &Auth6Message{},
+			"06fdfeff000102030405060708090a0b0c000000006553f100404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f"},
+		{"dhcp6", &DHCP6Message{Type: DHCP6, Timestamp: 1700000000, Cidr: cidr("fd00::1/64", 64), Hash: hash32(0x50)}, &DHCP6Message{},
+			"07000000006553f100666430303a3a312f3634000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000505152535455565758595a5b5c5d5e5f606162636465666768696a6b6c6d6e6f"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			golden, err := hex.DecodeString(tt.golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buffer, err := tt.input.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(buffer); got != tt.golden {
+				t.Errorf("marshal\n got %v\nwant %v", got, tt.golden)
+			}
+
+			if err := tt.output.UnmarshalBinary(golden); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.output, tt.input) {
+				t.Errorf("unmarshal\n got %+v\nwant %+v", tt.output, tt.input)
+			}
+
+			if err := tt.output.UnmarshalBinary(golden[:len(golden)-1]); err == nil {
+				t.Errorf("unmarshal of a short message succeeded")
+			}
+		})
+	}
+}
+
+func TestNulTerminated(t *testing.T) {
+	tests := []struct {
+		field []byte
+		want  string
+	}{
+		{cidr("10.4.0.1/24", 32), "10.4.0.1/24"},
+		{make([]byte, 32), ""},
+		{[]byte("fd00:0000:0000:0000:0000:0000:0000:0001/64"), "fd00:0000:0000:0000:0000:0000:0000:0001/64"},
+	}
+	for _, tt := range tests {
+		if got := nulTerminated(tt.field); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package candy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Credential{})
+	})
+}
+
+// Credential is a key bound to one device. Devices with a key must sign their
+// messages with it instead of the shared domain password. The key is derived
+// from Salt and the secret of the server and only shown when it is issued, the
+// database keeps its hash. A revoked credential rejects the device until a new
+// key is issued or the credential is removed.
+type Credential struct {
+	Domain    string `gorm:"primaryKey"`
+	VMac      string `gorm:"primaryKey"`
+	Salt      string
+	Hash      string
+	Revoked   bool
+	CreatedAt time.Time
+}
+
+func deriveKey(record *Credential) string {
+	mac := hmac.New(sha256.New, storage.Secret())
+	mac.Write([]byte(record.Domain + "/" + record.VMac + "/" + record.Salt))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// loadCredentials derives the keys of a domain. Revoked credentials, and those
+// whose hash no longer matches because the server secret changed, map to an
+// empty key.
+func loadCredentials(domain *Domain) {
+	var records []Credential
+	storage.Where(&Credential{Domain: domain.Name}).Find(&records)
+
+	domain.credentials = make(map[string]string)
+	for idx := range records {
+		record := &records[idx]
+		key := ""
+		if !record.Revoked {
+			key = deriveKey(record)
+		}
+		if key != "" && hashKey(key) != record.Hash {
+			logger.Debugf("device key does not match: domain=%v vmac=%v", record.Domain, record.VMac)
+			key = ""
+		}
+		domain.credentials[record.VMac] = key
+	}
+}
+
+// deviceSecret returns the secret that the device with vmac signs with.
+func deviceSecret(domain *Domain, vmac string) (string, error) {
+	if key, ok := domain.credentials[vmac]; ok {
+		if key == "" {
+			return "", reject(UNAUTHORIZED, errors.New("device key revoked: "+vmac))
+		}
+		return key, nil
+	}
+	if domain.KeyOnly {
+		return "", reject(UNAUTHORIZED, errors.New("device key required: "+vmac))
+	}
+	return domain.Password, nil
+}
+
+// IssueCredential binds a new key to a device and returns it. The key cannot
+// be shown again.
+func IssueCredential(name, vmac string) (string, error) {
+	if _, err := strconv.ParseUint(vmac, 16, 64); err != nil || len(vmac) != 16 {
+		return "", errors.New("invalid credential vmac: " + vmac)
+	}
+
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+
+	credential := &Credential{Domain: name, VMac: vmac, Salt: hex.EncodeToString(buffer), CreatedAt: time.Now()}
+	key := deriveKey(credential)
+	credential.Hash = hashKey(key)
+	if result := storage.Save(credential); result.Error != nil {
+		return "", result.Error
+	}
+
+	ReloadCredentials(name, vmac)
+	return key, nil
+}
+
+// RevokeCredential invalidates the key of a device. The device is rejected,
+// rather than falling back to the shared password, until it gets a new key.
+func RevokeCredential(name, vmac string) {
+	storage.Model(&Credential{Domain: name, VMac: vmac}).Updates(map[string]interface{}{"salt": "", "hash": "", "revoked": true})
+	ReloadCredentials(name, vmac)
+}
+
+// RemoveCredential lets a device sign with the shared password again.
+func RemoveCredential(name, vmac string) {
+	storage.Delete(&Credential{Domain: name, VMac: vmac})
+	ReloadCredentials(name, vmac)
+}
+
+// ReloadCredentials refreshes the keys of a domain and closes the connections
+// of vmac, which have to authenticate again with the current key.
+func ReloadCredentials(name, vmac string) {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		loadCredentials(domain)
+
+		for ws, device := range domain.wsDeviceMap {
+			if device.VMac == vmac {
+				ws.closeFor(KICKED)
+			}
+		}
+	}
+}
+
+func UpdateKeyOnly(name string, keyOnly bool) error {
+	if result := storage.Model(&Domain{Name: name}).Update("key_only", keyOnly); result.Error != nil {
+		return result.Error
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		domain.KeyOnly = keyOnly
+
+		if keyOnly {
+			for ws, device := range domain.wsDeviceMap {
+				if domain.credentials[device.VMac] == "" {
+					ws.closeFor(KICKED)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -1,28 +1,28 @@
 package candy
 
 import (
+	"context"
 	"encoding/binary"
-	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/lanthora/cucurbita/logger"
 	"github.com/lanthora/cucurbita/storage"
 )
 
 func init() {
-	err := storage.AutoMigrate(Domain{})
-	if err != nil {
-		logger.Fatal(err)
-	}
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Domain{})
+	})
 }
 
 type Device struct {
 	Domain        string `gorm:"primaryKey"`
 	VMac          string `gorm:"primaryKey"`
 	IP            string
+	IP6           string
 	Country       string
 	Region        string
 	Online        bool
@@ -31,29 +31,107 @@ type Device struct {
 	TX            uint64
 	OS            string
 	Version       string
+	Rate          uint64
+	Quota         uint64
+	Status        string
+	Outdated      bool
+
+	// Dropped counts the frames of the device that its rate or broadcast
+	// limit dropped, QueueDropped the frames to it that did not fit into its
+	// send queue.
+	Dropped      uint64
+	QueueDropped uint64
+
+	ip        uint32
+	ip6       [16]byte
+	limiter   bucket
+	overQuota bool
+	sampledRX uint64
+	sampledTX uint64
+	storm     stormGuard
 
-	ip uint32
+	advertised map[string]bool
+	deleted    bool
 }
 
 type Domain struct {
 	Name      string `gorm:"primaryKey"`
 	Password  string
 	DHCP      string
+	DHCP6     string
 	Broadcast bool
+	Strategy  string
+	KeyOnly   bool
+	Approval  bool
+	Skew      int64
+
+	MinVersion     string
+	BlockedVersion string
+
+	FloodGroups string
+
+	Monitor         string
+	MirroredDevices string
+	MirrorRate      uint64
 
-	mask   uint32
-	netID  uint32
-	hostID uint32
+	ExitNode       string
+	BackupExitNode string
+
+	DeviceRate    uint64
+	DomainRate    uint64
+	BroadcastRate uint64
+
+	DeviceQuota     uint64
+	DomainQuota     uint64
+	QuotaPeriod     int
+	QuotaAction     string
+	PeriodStartedAt time.Time
+
+	mask    uint32
+	netID   uint32
+	prefix6 *net.IPNet
+
+	// period is held by rollPeriod while it archives the counters and by
+	// connecting devices while they load theirs.
+	period sync.RWMutex
 
 	mutex       sync.RWMutex
 	wsDeviceMap map[*Websocket]*Device
 	ipWsMap     map[uint32]*Websocket
+	ip6WsMap    map[[16]byte]*Websocket
+	vmacWsMap   map[string]*Websocket
+	rules       []rule
+
+	reservations []reservation
+	leases       map[uint32]*Lease
+	routes       []route
+	bridges      []bridge
+	limiter      bucket
+	overQuota    bool
+	credentials  map[string]string
+	replay       replayCache
+	groups       multicastGroups
+	floodGroups  []network
+	capture      *capture
+
+	mirrored      map[string]bool
+	mirrorLimiter bucket
 }
 
 type Websocket struct {
 	conn   *websocket.Conn
-	banned bool
+	secret string
+	vmac   string
 	mutex  sync.Mutex
+
+	queue      chan []byte
+	done       chan struct{}
+	dropped    atomic.Uint64
+	stuckSince atomic.Int64
+
+	remote  string
+	session *Session
+	reason  atomic.Pointer[string]
 }
 
 func (ws *Websocket) UpdateReadDeadline() error {
@@ -62,21 +140,51 @@ func (ws *Websocket) UpdateReadDeadline() error {
 	return ws.conn.SetReadDeadline((time.Now().Add(30 * time.Second)))
 }
 
-func (ws *Websocket) WriteMessage(buffer []byte) error {
-	ws.mutex.Lock()
-	defer ws.mutex.Unlock()
-	return ws.conn.WriteMessage(websocket.BinaryMessage, buffer)
-}
-
 func (ws *Websocket) WritePong(buffer []byte) error {
 	ws.mutex.Lock()
 	defer ws.mutex.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	return ws.conn.WriteMessage(websocket.PongMessage, buffer)
 }
 
 var nameDomainMap map[string]*Domain = make(map[string]*Domain)
 var nameDomainMapMutex sync.RWMutex
 
+// loadedDomains returns the domains loaded so far, so that periodic tasks can
+// visit them without holding nameDomainMapMutex.
+func loadedDomains() []*Domain {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	domains := make([]*Domain, 0, len(nameDomainMap))
+	for _, domain := range nameDomainMap {
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// Start runs the periodic tasks until ctx is done. The returned channel is
+// closed once they all stopped.
+func Start(ctx context.Context) <-chan struct{} {
+	tasks := []func(context.Context){runFlush, runHistory, runQuotas, runSessions}
+
+	var wg sync.WaitGroup
+	wg.Add(len(tasks))
+	for _, task := range tasks {
+		go func(task func(context.Context)) {
+			defer wg.Done()
+			task(ctx)
+		}(task)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
 func GetDomain(name string) *Domain {
 	nameDomainMapMutex.Lock()
 	defer nameDomainMapMutex.Unlock()
@@ -95,16 +203,30 @@ func GetDomain(name string) *Domain {
 	if err == nil {
 		domain.netID = binary.BigEndian.Uint32(ipNet.IP)
 		domain.mask = binary.BigEndian.Uint32(ipNet.Mask)
-		domain.hostID = rand.Uint32() & ^domain.mask
 
 		if ^domain.mask < 2 {
 			return nil
 		}
-		updateHostID(domain)
 	}
 
+	_, ipNet, err = net.ParseCIDR(domain.DHCP6)
+	if err == nil && isUniqueLocal(ipNet) {
+		domain.prefix6 = ipNet
+	}
+
+	domain.limiter.setRate(domain.DomainRate)
 	domain.wsDeviceMap = make(map[*Websocket]*Device)
 	domain.ipWsMap = make(map[uint32]*Websocket)
+	domain.ip6WsMap = make(map[[16]byte]*Websocket)
+	domain.vmacWsMap = make(map[string]*Websocket)
+	loadRules(domain)
+	loadReservations(domain)
+	loadLeases(domain)
+	loadRoutes(domain)
+	loadBridges(domain)
+	loadCredentials(domain)
+	loadFloodGroups(domain)
+	loadMirror(domain)
 
 	nameDomainMap[name] = domain
 	return domain
@@ -119,32 +241,22 @@ func DeleteDomain(name string) {
 		defer domain.mutex.RUnlock()
 
 		for ws := range domain.wsDeviceMap {
-			ws.conn.Close()
+			ws.closeFor(KICKED)
 		}
 	}
 
 	delete(nameDomainMap, name)
 	storage.Delete(&Domain{Name: name})
-}
-
-func updateHostID(domain *Domain) {
-	for ok := true; ok; ok = (domain.hostID == 0 || domain.hostID == ^domain.mask) {
-		domain.hostID = (domain.hostID + 1) & (^domain.mask)
-	}
-}
-
-func Sync() {
-	nameDomainMapMutex.RLock()
-	defer nameDomainMapMutex.RUnlock()
-
-	for _, domain := range nameDomainMap {
-		domain.mutex.RLock()
-		defer domain.mutex.RUnlock()
-
-		for _, device := range domain.wsDeviceMap {
-			if device.Online {
-				storage.Save(device)
-			}
-		}
-	}
+	storage.Delete(&Rule{}, "domain = ?", name)
+	storage.Delete(&Reservation{}, "domain = ?", name)
+	storage.Delete(&Lease{}, "domain = ?", name)
+	storage.Delete(&Route{}, "domain = ?", name)
+	storage.Delete(&Bridge{}, "domain = ? OR peer = ?", name, name)
+	storage.Delete(&Credential{}, "domain = ?", name)
+	storage.Delete(&Ban{}, "domain = ?", name)
+	storage.Delete(&Denial{}, "domain = ?", name)
+	storage.Delete(&Traffic{}, "domain = ?", name)
+	storage.Delete(&Usage{}, "domain = ?", name)
+	storage.Delete(&Storm{}, "domain = ?", name)
+	storage.Delete(&Session{}, "domain = ?", name)
 }
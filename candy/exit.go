@@ -0,0 +1,94 @@
+package candy
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+// exitNode returns the first online device of the designated exit nodes, so
+// that the backup takes over as soon as the primary goes offline.
+func exitNode(domain *Domain) (*Websocket, *Device) {
+	for _, vmac := range []string{domain.ExitNode, domain.BackupExitNode} {
+		if vmac == "" {
+			continue
+		}
+		if ws, device := findOnlineDevice(domain, vmac); ws != nil && device.ip != 0 {
+			return ws, device
+		}
+	}
+	return nil, nil
+}
+
+func isExitNode(domain *Domain, device *Device) bool {
+	return device.VMac == domain.ExitNode || device.VMac == domain.BackupExitNode
+}
+
+func isOutside(domain *Domain, ip uint32) bool {
+	if ip&domain.mask == domain.netID {
+		return false
+	}
+	if ip == 0xFFFFFFFF || ip&0xF0000000 == 0xE0000000 {
+		return false
+	}
+	return true
+}
+
+func UpdateExitNode(name, primary, backup string) error {
+	for _, vmac := range []string{primary, backup} {
+		if _, err := strconv.ParseUint(vmac, 16, 64); vmac != "" && (err != nil || len(vmac) != 16) {
+			return errors.New("invalid exit node vmac: " + vmac)
+		}
+	}
+
+	// Without an address pool every address counts as inside the domain, so
+	// there would be nothing for an exit node to carry.
+	record := &Domain{}
+	if result := storage.Where("name = ?", name).Take(record); result.Error != nil {
+		return result.Error
+	}
+	if record.DHCP == "" && (primary != "" || backup != "") {
+		return errors.New("exit node needs a domain with dhcp")
+	}
+
+	result := storage.Model(&Domain{Name: name}).Updates(map[string]interface{}{"exit_node": primary, "backup_exit_node": backup})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		domain.ExitNode = primary
+		domain.BackupExitNode = backup
+		broadcastRoutes(domain)
+	}
+	return nil
+}
+
+func ActiveExitNode(name string) string {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.RLock()
+		defer domain.mutex.RUnlock()
+		if _, device := exitNode(domain); device != nil {
+			return device.VMac
+		}
+	}
+	return ""
+}
+
+func logExitNode(domain *Domain) {
+	if _, device := exitNode(domain); device != nil {
+		logger.Debugf("exit node: domain=%v vmac=%v", domain.Name, device.VMac)
+	} else {
+		logger.Debugf("exit node: domain=%v offline", domain.Name)
+	}
+}
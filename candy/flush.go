@@ -0,0 +1,251 @@
+package candy
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+	"gorm.io/gorm"
+)
+
+// Devices are written behind: handlers only mark them dirty and Sync saves
+// them together with the counters of every online device and the other rows
+// queued in the meantime.
+const defaultFlushInterval = 10 * time.Second
+
+// A write that failed this many syncs in a row is dropped.
+const maxSyncAttempts = 5
+
+// dirtyDevices maps the devices to save to the number of syncs that failed to
+// save them.
+var dirtyDevices = struct {
+	mutex sync.Mutex
+	m     map[*Device]int
+}{m: make(map[*Device]int)}
+
+// markDirty schedules device to be saved by the next Sync. The caller holds the
+// lock of its domain.
+func markDirty(device *Device) {
+	if device.deleted {
+		return
+	}
+	dirtyDevices.mutex.Lock()
+	defer dirtyDevices.mutex.Unlock()
+	dirtyDevices.m[device] = 0
+}
+
+// loadUnsavedCounters copies the counters of the latest connection of device
+// that disconnected and was not saved yet, since storage does not have them.
+// The caller holds the lock of its domain.
+func loadUnsavedCounters(device *Device) {
+	dirtyDevices.mutex.Lock()
+	defer dirtyDevices.mutex.Unlock()
+
+	var latest *Device
+	for dirty := range dirtyDevices.m {
+		if dirty == device || dirty.Online || dirty.Domain != device.Domain || dirty.VMac != device.VMac {
+			continue
+		}
+		if latest == nil || latest.ConnUpdatedAt.Before(dirty.ConnUpdatedAt) {
+			latest = dirty
+		}
+	}
+	if latest != nil {
+		device.RX, device.TX = latest.RX, latest.TX
+	}
+}
+
+type pendingWrite struct {
+	write    func(tx *gorm.DB) error
+	attempts int
+}
+
+// pendingWrites holds the writes of rows other than devices in the order they
+// were queued.
+var pendingWrites = struct {
+	mutex  sync.Mutex
+	writes []pendingWrite
+}{}
+
+// queueWrite schedules a write for the next Sync, so that handlers holding the
+// domain lock do not wait for storage. The write runs in the transaction of
+// Sync and must only use values that are not modified after it was queued.
+func queueWrite(write func(tx *gorm.DB) error) {
+	pendingWrites.mutex.Lock()
+	defer pendingWrites.mutex.Unlock()
+	pendingWrites.writes = append(pendingWrites.writes, pendingWrite{write: write})
+}
+
+// runFlush syncs every flush interval until ctx is done.
+func runFlush(ctx context.Context) {
+	for {
+		timer := time.NewTimer(flushInterval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			Sync()
+		}
+	}
+}
+
+// syncMutex keeps the writes of concurrent syncs in order.
+var syncMutex sync.Mutex
+
+// flushInterval reads the interval from the flush_interval config in seconds,
+// so that it can be changed without a restart.
+func flushInterval() time.Duration {
+	config := &storage.Config{Key: "flush_interval"}
+	if result := storage.Where(config).Take(config); result.Error == nil {
+		if seconds, err := strconv.Atoi(config.Value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultFlushInterval
+}
+
+// record copies the persisted fields of a device.
+func record(device *Device) Device {
+	return Device{
+		Domain:        device.Domain,
+		VMac:          device.VMac,
+		IP:            device.IP,
+		IP6:           device.IP6,
+		Country:       device.Country,
+		Region:        device.Region,
+		Online:        device.Online,
+		ConnUpdatedAt: device.ConnUpdatedAt,
+		RX:            device.RX,
+		TX:            device.TX,
+		OS:            device.OS,
+		Version:       device.Version,
+		Rate:          device.Rate,
+		Dropped:       device.Dropped,
+		QueueDropped:  device.QueueDropped,
+		Quota:         device.Quota,
+		Status:        device.Status,
+		Outdated:      device.Outdated,
+	}
+}
+
+// Sync saves the dirty devices, the counters of every online device and the
+// queued writes in one transaction. It runs periodically, before the device
+// page is rendered and once more on shutdown. When the transaction fails, each
+// write is retried on its own and the failed ones are kept for the next Sync,
+// up to maxSyncAttempts times.
+func Sync() {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+	syncLocked()
+}
+
+// syncLocked is Sync for callers that hold syncMutex.
+func syncLocked() {
+	dirtyDevices.mutex.Lock()
+	dirty := dirtyDevices.m
+	dirtyDevices.m = make(map[*Device]int)
+	dirtyDevices.mutex.Unlock()
+
+	pendingWrites.mutex.Lock()
+	writes := pendingWrites.writes
+	pendingWrites.writes = nil
+	pendingWrites.mutex.Unlock()
+
+	var online []Device
+	var onlineOwners []*Device
+	connected := make(map[*Device]bool)
+	for _, domain := range loadedDomains() {
+		domain.mutex.Lock()
+		for ws, device := range domain.wsDeviceMap {
+			if device.deleted {
+				continue
+			}
+			if _, ok := dirty[device]; device.Online || ok {
+				device.QueueDropped += ws.dropped.Swap(0)
+				online = append(online, record(device))
+				onlineOwners = append(onlineOwners, device)
+				connected[device] = true
+			}
+		}
+		domain.mutex.Unlock()
+	}
+
+	// Devices that disconnected or belong to no connection any more are saved
+	// first, oldest first, so that they do not overwrite a newer connection
+	// of the same device.
+	var owners []*Device
+	for device := range dirty {
+		if !connected[device] {
+			owners = append(owners, device)
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		return owners[i].ConnUpdatedAt.Before(owners[j].ConnUpdatedAt)
+	})
+	var records []Device
+	for _, device := range owners {
+		records = append(records, record(device))
+	}
+	records = append(records, online...)
+	owners = append(owners, onlineOwners...)
+
+	if len(records) == 0 && len(writes) == 0 {
+		return
+	}
+	err := storage.Transaction(func(tx *gorm.DB) error {
+		for idx := range records {
+			if result := tx.Save(&records[idx]); result.Error != nil {
+				return result.Error
+			}
+		}
+		for _, write := range writes {
+			if err := write.write(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		return
+	}
+	logger.Debug("sync devices: ", err)
+
+	// Saving one at a time keeps a write that always fails from holding back
+	// the others.
+	dirtyDevices.mutex.Lock()
+	for idx := range records {
+		result := storage.Save(&records[idx])
+		attempts, ok := dirty[owners[idx]]
+		if result.Error == nil || !ok {
+			continue
+		}
+		if _, ok := dirtyDevices.m[owners[idx]]; ok {
+			continue
+		}
+		if attempts+1 < maxSyncAttempts {
+			dirtyDevices.m[owners[idx]] = attempts + 1
+		} else {
+			logger.Debugf("drop device: domain=%v vmac=%v err=%v", records[idx].Domain, records[idx].VMac, result.Error)
+		}
+	}
+	dirtyDevices.mutex.Unlock()
+
+	var failed []pendingWrite
+	for _, write := range writes {
+		if err := storage.Transaction(write.write); err != nil {
+			if write.attempts+1 < maxSyncAttempts {
+				failed = append(failed, pendingWrite{write: write.write, attempts: write.attempts + 1})
+			} else {
+				logger.Debug("drop write: ", err)
+			}
+		}
+	}
+	pendingWrites.mutex.Lock()
+	pendingWrites.writes = append(failed, pendingWrites.writes...)
+	pendingWrites.mutex.Unlock()
+}
@@ -0,0 +1,38 @@
+package candy
+
+import (
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestSyncDropsFailingWrite(t *testing.T) {
+	failures, successes := 0, 0
+	queueWrite(func(tx *gorm.DB) error {
+		failures++
+		return errors.New("constraint failed")
+	})
+	queueWrite(func(tx *gorm.DB) error {
+		successes++
+		return nil
+	})
+
+	Sync()
+	if successes != 1 {
+		t.Errorf("write next to a failing one ran %v times, want 1", successes)
+	}
+	for i := 1; i < maxSyncAttempts; i++ {
+		Sync()
+	}
+	if failures != maxSyncAttempts*2 {
+		t.Errorf("failing write ran %v times, want %v", failures, maxSyncAttempts*2)
+	}
+	if len(pendingWrites.writes) != 0 {
+		t.Errorf("%v writes still pending", len(pendingWrites.writes))
+	}
+	Sync()
+	if failures != maxSyncAttempts*2 || successes != 1 {
+		t.Errorf("dropped write ran again")
+	}
+}
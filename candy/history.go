@@ -0,0 +1,208 @@
+package candy
+
+import (
+	"context"
+	"time"
+
+	"github.com/lanthora/cucurbita/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Traffic{})
+	})
+}
+
+// runHistory samples the traffic every minute and rolls it up every hour
+// until ctx is done.
+func runHistory(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	rolledUpAt := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sampleTraffic(now)
+			if now.Sub(rolledUpAt) >= time.Hour {
+				rollUpTraffic(now)
+				rolledUpAt = now
+			}
+		}
+	}
+}
+
+// Resolutions of the traffic history. Samples are taken every minute, rolled
+// up into hours after minuteRetention and into days after hourRetention.
+const (
+	MINUTE = "minute"
+	HOUR   = "hour"
+	DAY    = "day"
+)
+
+const (
+	minuteRetention = 24 * time.Hour
+	hourRetention   = 30 * 24 * time.Hour
+	dayRetention    = 365 * 24 * time.Hour
+)
+
+// Traffic is the number of bytes a device received and sent during the
+// interval of the given resolution starting at StartedAt.
+type Traffic struct {
+	Domain     string    `gorm:"primaryKey"`
+	VMac       string    `gorm:"primaryKey"`
+	Resolution string    `gorm:"primaryKey"`
+	StartedAt  time.Time `gorm:"primaryKey"`
+	RX         uint64
+	TX         uint64
+}
+
+// markSampled starts counting from the current counters of a device that was
+// just loaded from storage.
+func markSampled(device *Device) {
+	device.sampledRX = device.RX
+	device.sampledTX = device.TX
+}
+
+// sampleDevice returns the traffic of device since it was last sampled. The
+// counters are reset at the start of each quota period, in which case the
+// current value is the whole delta.
+func sampleDevice(domain *Domain, device *Device, now time.Time) Traffic {
+	delta := func(current, sampled uint64) uint64 {
+		if current < sampled {
+			return current
+		}
+		return current - sampled
+	}
+	sample := Traffic{
+		Domain:     domain.Name,
+		VMac:       device.VMac,
+		Resolution: MINUTE,
+		StartedAt:  now.Truncate(time.Minute),
+		RX:         delta(device.RX, device.sampledRX),
+		TX:         delta(device.TX, device.sampledTX),
+	}
+	markSampled(device)
+	return sample
+}
+
+// saveTraffic adds the samples to the rows of their interval.
+func saveTraffic(samples []Traffic) {
+	storage.Transaction(func(tx *gorm.DB) error {
+		return addTraffic(tx, samples)
+	})
+}
+
+// addTraffic adds the samples to the rows of their interval within tx.
+func addTraffic(tx *gorm.DB, samples []Traffic) error {
+	var rows []Traffic
+	for _, sample := range samples {
+		if sample.RX != 0 || sample.TX != 0 {
+			rows = append(rows, sample)
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return tx.Model(&Traffic{}).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "domain"}, {Name: "vmac"}, {Name: "resolution"}, {Name: "started_at"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "rx"}, Value: clause.Expr{SQL: "rx + excluded.rx"}},
+			{Column: clause.Column{Name: "tx"}, Value: clause.Expr{SQL: "tx + excluded.tx"}},
+		},
+	}).Create(&rows).Error
+}
+
+// sampleTraffic records the traffic of every online device.
+func sampleTraffic(now time.Time) {
+	var samples []Traffic
+	for _, domain := range loadedDomains() {
+		domain.mutex.Lock()
+		for _, device := range domain.wsDeviceMap {
+			if device.Online {
+				samples = append(samples, sampleDevice(domain, device, now))
+			}
+		}
+		domain.mutex.Unlock()
+	}
+	saveTraffic(samples)
+}
+
+// rollUpTraffic merges the rows that outlived their resolution into the next
+// coarser one and drops the days beyond retention.
+func rollUpTraffic(now time.Time) {
+	rollUp := func(from, to string, cutoff time.Time, truncate func(time.Time) time.Time) {
+		var rows []Traffic
+		storage.Where("resolution = ? AND started_at < ?", from, cutoff).Find(&rows)
+		if len(rows) == 0 {
+			return
+		}
+
+		merged := make(map[Traffic]*Traffic)
+		for _, row := range rows {
+			key := Traffic{Domain: row.Domain, VMac: row.VMac, Resolution: to, StartedAt: truncate(row.StartedAt)}
+			if merged[key] == nil {
+				merged[key] = &Traffic{Domain: key.Domain, VMac: key.VMac, Resolution: to, StartedAt: key.StartedAt}
+			}
+			merged[key].RX += row.RX
+			merged[key].TX += row.TX
+		}
+
+		samples := make([]Traffic, 0, len(merged))
+		for _, row := range merged {
+			samples = append(samples, *row)
+		}
+		saveTraffic(samples)
+		storage.Delete(&Traffic{}, "resolution = ? AND started_at < ?", from, cutoff)
+	}
+
+	hour := func(t time.Time) time.Time { return t.Truncate(time.Hour) }
+	day := func(t time.Time) time.Time {
+		year, month, date := t.Date()
+		return time.Date(year, month, date, 0, 0, 0, 0, t.Location())
+	}
+
+	rollUp(MINUTE, HOUR, hour(now.Add(-minuteRetention)), hour)
+	rollUp(HOUR, DAY, day(now.Add(-hourRetention)), day)
+	storage.Delete(&Traffic{}, "resolution = ? AND started_at < ?", DAY, now.Add(-dayRetention))
+}
+
+// TrafficHistory returns the traffic of a domain, or of one device when vmac
+// is not empty, between since and until in buckets of the given size. Rows of
+// every resolution are merged, so recent minutes and older hours line up.
+func TrafficHistory(name, vmac string, since, until time.Time, bucket time.Duration) []Traffic {
+	query := storage.Where("domain = ? AND started_at >= ? AND started_at < ?", name, since, until)
+	if vmac != "" {
+		query = query.Where("vmac = ?", vmac)
+	}
+	var rows []Traffic
+	query.Find(&rows)
+
+	count := int(until.Sub(since) / bucket)
+	result := make([]Traffic, count)
+	for idx := range result {
+		result[idx] = Traffic{Domain: name, VMac: vmac, StartedAt: since.Add(time.Duration(idx) * bucket)}
+	}
+	for _, row := range rows {
+		if idx := int(row.StartedAt.Sub(since) / bucket); idx >= 0 && idx < count {
+			result[idx].RX += row.RX
+			result[idx].TX += row.TX
+		}
+	}
+	return result
+}
+
+// TopTraffic returns the traffic of each device of a domain between since and
+// until, largest first.
+func TopTraffic(name string, since, until time.Time) []Traffic {
+	var rows []Traffic
+	storage.Model(&Traffic{}).Select("domain, vmac, SUM(rx) AS rx, SUM(tx) AS tx").
+		Where("domain = ? AND started_at >= ? AND started_at < ?", name, since, until).
+		Group("domain, vmac").Order("SUM(rx + tx) DESC").Find(&rows)
+	return rows
+}
@@ -0,0 +1,249 @@
+package candy
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+	"gorm.io/gorm"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Lease{})
+	})
+}
+
+const (
+	SEQUENTIAL = "sequential"
+	RANDOM     = "random"
+	HASH       = "hash"
+)
+
+// Leases outlive the connection by the same period after which the device
+// page considers a device dormant, so returning devices keep their address.
+const leaseDuration = 7 * 24 * time.Hour
+
+type Lease struct {
+	Domain    string `gorm:"primaryKey"`
+	VMac      string `gorm:"primaryKey"`
+	IP        string
+	ExpiresAt time.Time
+
+	ip uint32
+}
+
+func loadLeases(domain *Domain) {
+	var records []Lease
+	storage.Where(&Lease{Domain: domain.Name}).Find(&records)
+
+	domain.leases = make(map[uint32]*Lease)
+	for idx := range records {
+		lease := &records[idx]
+		ip, err := ipToUint32(lease.IP)
+		if err != nil || ip&domain.mask != domain.netID || time.Now().After(lease.ExpiresAt) {
+			storage.Delete(lease)
+			continue
+		}
+		lease.ip = ip
+		domain.leases[ip] = lease
+	}
+}
+
+func findLease(domain *Domain, vmac string) *Lease {
+	for _, lease := range domain.leases {
+		if lease.VMac == vmac {
+			return lease
+		}
+	}
+	return nil
+}
+
+func isLeaseActive(domain *Domain, lease *Lease) bool {
+	if _, ok := domain.ipWsMap[lease.ip]; ok {
+		return true
+	}
+	return time.Now().Before(lease.ExpiresAt)
+}
+
+// reclaimLeases forgets the expired leases of devices that are not connected,
+// so that dormant devices give their addresses back while the server runs.
+func reclaimLeases(domain *Domain) {
+	for ip, lease := range domain.leases {
+		if !isLeaseActive(domain, lease) {
+			delete(domain.leases, ip)
+			deleteLease(lease)
+		}
+	}
+}
+
+func isAddressAvailable(domain *Domain, vmac string, ip uint32) bool {
+	if ip&domain.mask != domain.netID {
+		return false
+	}
+	if hostID := ip & ^domain.mask; hostID == 0 || hostID == ^domain.mask {
+		return false
+	}
+	if isExcluded(domain, ip) {
+		return false
+	}
+	if ws, ok := domain.ipWsMap[ip]; ok {
+		if device, ok := domain.wsDeviceMap[ws]; !ok || device.VMac != vmac {
+			return false
+		}
+	}
+	if lease, ok := domain.leases[ip]; ok && lease.VMac != vmac && isLeaseActive(domain, lease) {
+		return false
+	}
+	return true
+}
+
+func startHostID(domain *Domain, vmac string) uint32 {
+	switch domain.Strategy {
+	case RANDOM:
+		return rand.Uint32()
+	case HASH:
+		h := fnv.New32a()
+		h.Write([]byte(vmac))
+		return h.Sum32()
+	default:
+		return 1
+	}
+}
+
+func allocateAddress(domain *Domain, vmac string) (uint32, error) {
+	if lease := findLease(domain, vmac); lease != nil && isAddressAvailable(domain, vmac, lease.ip) {
+		return lease.ip, nil
+	}
+
+	reclaimLeases(domain)
+
+	start := startHostID(domain, vmac)
+	for offset := uint64(0); offset <= uint64(^domain.mask); offset++ {
+		ip := domain.netID | ((start + uint32(offset)) & ^domain.mask)
+		if isAddressAvailable(domain, vmac, ip) {
+			return ip, nil
+		}
+	}
+
+	logger.Debugf("address pool exhausted: domain=%v dhcp=%v", domain.Name, domain.DHCP)
+	return 0, reject(EXHAUSTED, errors.New("not enough addresses"))
+}
+
+func updateLease(domain *Domain, vmac string, ip uint32) {
+	if lease := findLease(domain, vmac); lease != nil && lease.ip != ip {
+		delete(domain.leases, lease.ip)
+	}
+	if lease, ok := domain.leases[ip]; ok && lease.VMac != vmac {
+		deleteLease(lease)
+	}
+
+	lease := &Lease{Domain: domain.Name, VMac: vmac, IP: uint32ToIpString(ip), ExpiresAt: time.Now().Add(leaseDuration), ip: ip}
+	domain.leases[ip] = lease
+	row := *lease
+	queueWrite(func(tx *gorm.DB) error { return tx.Save(&row).Error })
+}
+
+func deleteLease(lease *Lease) {
+	row := *lease
+	queueWrite(func(tx *gorm.DB) error { return tx.Delete(&row).Error })
+}
+
+// isUniqueLocal reports whether prefix lies in fc00::/7 and leaves room for
+// host addresses.
+func isUniqueLocal(prefix *net.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	if bits != 128 || ones > 120 {
+		return false
+	}
+	return prefix.IP[0]&0xFE == 0xFC
+}
+
+func isAddress6Available(domain *Domain, vmac string, ip [16]byte) bool {
+	if !domain.prefix6.Contains(ip[:]) {
+		return false
+	}
+	hasHostID := false
+	for idx := range ip {
+		hasHostID = hasHostID || ip[idx]&^domain.prefix6.Mask[idx] != 0
+	}
+	if !hasHostID {
+		return false
+	}
+	if ws, ok := domain.ip6WsMap[ip]; ok {
+		if device, ok := domain.wsDeviceMap[ws]; !ok || device.VMac != vmac {
+			return false
+		}
+	}
+	return true
+}
+
+// allocateAddress6 derives the interface identifier from vmac, so that a
+// device gets the same address every time without keeping leases for a
+// prefix that can never be exhausted in practice.
+func allocateAddress6(domain *Domain, vmac string) ([16]byte, error) {
+	h := fnv.New64a()
+	h.Write([]byte(vmac))
+	start := h.Sum64()
+
+	for offset := uint64(0); offset < 256; offset++ {
+		var hostID, ip [16]byte
+		binary.BigEndian.PutUint64(hostID[8:], start+offset)
+		for idx := range ip {
+			ip[idx] = domain.prefix6.IP[idx] | hostID[idx]&^domain.prefix6.Mask[idx]
+		}
+		if isAddress6Available(domain, vmac, ip) {
+			return ip, nil
+		}
+	}
+
+	logger.Debugf("address pool exhausted: domain=%v dhcp6=%v", domain.Name, domain.DHCP6)
+	return [16]byte{}, reject(EXHAUSTED, errors.New("not enough addresses"))
+}
+
+// AddressUsage returns the number of leased addresses and the number of usable
+// host addresses, so that administrators can notice exhaustion early.
+// Domains that are not loaded are counted from storage, so that listing them
+// does not load them.
+func AddressUsage(name string) (used, total uint64) {
+	nameDomainMapMutex.RLock()
+	domain, ok := nameDomainMap[name]
+	nameDomainMapMutex.RUnlock()
+	if !ok {
+		return storedAddressUsage(name)
+	}
+	if domain.DHCP == "" {
+		return
+	}
+
+	domain.mutex.RLock()
+	defer domain.mutex.RUnlock()
+
+	total = uint64(^domain.mask) - 1
+	for _, lease := range domain.leases {
+		if isLeaseActive(domain, lease) {
+			used++
+		}
+	}
+	return
+}
+
+func storedAddressUsage(name string) (used, total uint64) {
+	domain := &Domain{}
+	if result := storage.Where("name = ?", name).Take(domain); result.Error != nil {
+		return
+	}
+	_, ipNet, err := net.ParseCIDR(domain.DHCP)
+	if err != nil || ipNet.IP.To4() == nil {
+		return
+	}
+
+	var count int64
+	storage.Model(&Lease{}).Where("domain = ? AND expires_at > ?", name, time.Now()).Count(&count)
+	return uint64(count), uint64(^binary.BigEndian.Uint32(ipNet.Mask)) - 1
+}
@@ -0,0 +1,190 @@
+package candy
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestDomain(t testing.TB, cidr, strategy string) *Domain {
+	t.Helper()
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Domain{
+		Name:        t.Name(),
+		DHCP:        cidr,
+		Strategy:    strategy,
+		netID:       binary.BigEndian.Uint32(ipNet.IP.To4()),
+		mask:        binary.BigEndian.Uint32(ipNet.Mask),
+		leases:      make(map[uint32]*Lease),
+		ipWsMap:     make(map[uint32]*Websocket),
+		vmacWsMap:   make(map[string]*Websocket),
+		wsDeviceMap: make(map[*Websocket]*Device),
+	}
+}
+
+func mustIP(t testing.TB, input string) uint32 {
+	t.Helper()
+	ip, err := ipToUint32(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip
+}
+
+func addLease(domain *Domain, vmac string, ip uint32, expiresAt time.Time) {
+	domain.leases[ip] = &Lease{Domain: domain.Name, VMac: vmac, IP: uint32ToIpString(ip), ExpiresAt: expiresAt, ip: ip}
+}
+
+func connect(domain *Domain, vmac string, ip uint32) {
+	ws := &Websocket{}
+	domain.wsDeviceMap[ws] = &Device{Domain: domain.Name, VMac: vmac, ip: ip, Online: true}
+	domain.ipWsMap[ip] = ws
+	domain.vmacWsMap[vmac] = ws
+}
+
+func TestAllocateAddressStrategies(t *testing.T) {
+	const vmac = "0123456789abcdef"
+
+	h := fnv.New32a()
+	h.Write([]byte(vmac))
+	hashed := h.Sum32() & 0xFF
+
+	tests := []struct {
+		name     string
+		strategy string
+		check    func(t *testing.T, domain *Domain, ip uint32)
+	}{
+		{"sequential", SEQUENTIAL, func(t *testing.T, domain *Domain, ip uint32) {
+			if want := mustIP(t, "10.0.0.1"); ip != want {
+				t.Errorf("got %v, want %v", uint32ToIpString(ip), uint32ToIpString(want))
+			}
+		}},
+		{"empty means sequential", "", func(t *testing.T, domain *Domain, ip uint32) {
+			if want := mustIP(t, "10.0.0.1"); ip != want {
+				t.Errorf("got %v, want %v", uint32ToIpString(ip), uint32ToIpString(want))
+			}
+		}},
+		{"hash", HASH, func(t *testing.T, domain *Domain, ip uint32) {
+			if hashed == 0 || hashed == 0xFF {
+				t.Skip("hash lands on a reserved host id")
+			}
+			if want := domain.netID | hashed; ip != want {
+				t.Errorf("got %v, want %v", uint32ToIpString(ip), uint32ToIpString(want))
+			}
+			again, err := allocateAddress(domain, vmac)
+			if err != nil || again != ip {
+				t.Errorf("hash is not stable: %v then %v", uint32ToIpString(ip), uint32ToIpString(again))
+			}
+		}},
+		{"random", RANDOM, func(t *testing.T, domain *Domain, ip uint32) {
+			if ip&domain.mask != domain.netID || !isAddressAvailable(domain, vmac, ip) {
+				t.Errorf("got unusable address %v", uint32ToIpString(ip))
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain := newTestDomain(t, "10.0.0.0/24", tt.strategy)
+			ip, err := allocateAddress(domain, vmac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, domain, ip)
+		})
+	}
+}
+
+func TestAllocateAddressConflicts(t *testing.T) {
+	const vmac = "000000000000000a"
+	const other = "000000000000000b"
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, domain *Domain)
+		want  string
+	}{
+		{"free pool", func(t *testing.T, domain *Domain) {}, "10.0.0.1"},
+		{"own lease is reused", func(t *testing.T, domain *Domain) {
+			addLease(domain, vmac, mustIP(t, "10.0.0.9"), time.Now().Add(time.Hour))
+		}, "10.0.0.9"},
+		{"own expired lease is reused", func(t *testing.T, domain *Domain) {
+			addLease(domain, vmac, mustIP(t, "10.0.0.9"), time.Now().Add(-time.Hour))
+		}, "10.0.0.9"},
+		{"active lease of another device", func(t *testing.T, domain *Domain) {
+			addLease(domain, other, mustIP(t, "10.0.0.1"), time.Now().Add(time.Hour))
+		}, "10.0.0.2"},
+		{"expired lease of another device", func(t *testing.T, domain *Domain) {
+			addLease(domain, other, mustIP(t, "10.0.0.1"), time.Now().Add(-time.Hour))
+		}, "10.0.0.1"},
+		{"expired lease of a connected device", func(t *testing.T, domain *Domain) {
+			addLease(domain, other, mustIP(t, "10.0.0.1"), time.Now().Add(-time.Hour))
+			connect(domain, other, mustIP(t, "10.0.0.1"))
+		}, "10.0.0.2"},
+		{"address pinned to another device", func(t *testing.T, domain *Domain) {
+			domain.reservations = []reservation{{vmac: other, first: mustIP(t, "10.0.0.1"), last: mustIP(t, "10.0.0.1")}}
+		}, "10.0.0.2"},
+		{"excluded range", func(t *testing.T, domain *Domain) {
+			domain.reservations = []reservation{{first: mustIP(t, "10.0.0.1"), last: mustIP(t, "10.0.0.10")}}
+		}, "10.0.0.11"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain := newTestDomain(t, "10.0.0.0/24", SEQUENTIAL)
+			tt.setup(t, domain)
+			ip, err := allocateAddress(domain, vmac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mustIP(t, tt.want); ip != want {
+				t.Errorf("got %v, want %v", uint32ToIpString(ip), tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateAddressExhausted(t *testing.T) {
+	domain := newTestDomain(t, "10.0.0.0/30", SEQUENTIAL)
+	addLease(domain, "000000000000000a", mustIP(t, "10.0.0.1"), time.Now().Add(time.Hour))
+	connect(domain, "000000000000000b", mustIP(t, "10.0.0.2"))
+
+	_, err := allocateAddress(domain, "000000000000000c")
+	var r *rejection
+	if !errors.As(err, &r) || r.reason != EXHAUSTED {
+		t.Fatalf("got %v, want an EXHAUSTED rejection", err)
+	}
+}
+
+func TestReclaimLeases(t *testing.T) {
+	domain := newTestDomain(t, "10.0.0.0/24", SEQUENTIAL)
+	expired, active, connected := mustIP(t, "10.0.0.1"), mustIP(t, "10.0.0.2"), mustIP(t, "10.0.0.3")
+	addLease(domain, "000000000000000a", expired, time.Now().Add(-time.Hour))
+	addLease(domain, "000000000000000b", active, time.Now().Add(time.Hour))
+	addLease(domain, "000000000000000c", connected, time.Now().Add(-time.Hour))
+	connect(domain, "000000000000000c", connected)
+
+	if _, err := allocateAddress(domain, "000000000000000d"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   uint32
+		want bool
+	}{
+		{expired, false},
+		{active, true},
+		{connected, true},
+	}
+	for _, tt := range tests {
+		if _, ok := domain.leases[tt.ip]; ok != tt.want {
+			t.Errorf("lease of %v kept = %v, want %v", uint32ToIpString(tt.ip), ok, tt.want)
+		}
+	}
+}
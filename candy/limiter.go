@@ -0,0 +1,151 @@
+package candy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lanthora/cucurbita/storage"
+)
+
+// Buckets hold at least this many bytes so that a single full sized frame can
+// always pass a low limit.
+const minBurst = 64 * 1024
+
+type bucket struct {
+	mutex     sync.Mutex
+	rate      uint64
+	tokens    float64
+	updatedAt time.Time
+}
+
+func (b *bucket) burst() float64 {
+	return float64(max(b.rate, minBurst))
+}
+
+func (b *bucket) setRate(rate uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rate = rate
+	b.tokens = b.burst()
+	b.updatedAt = time.Now()
+}
+
+// refill adds the tokens earned since the last update and reports whether
+// size bytes may pass. A zero rate means unlimited. The caller holds the mutex.
+func (b *bucket) refill(now time.Time, size int) bool {
+	if b.rate == 0 {
+		return true
+	}
+	b.tokens = min(b.burst(), b.tokens+now.Sub(b.updatedAt).Seconds()*float64(b.rate))
+	b.updatedAt = now
+	return b.tokens >= float64(size)
+}
+
+// take removes size bytes that refill allowed. The caller holds the mutex.
+func (b *bucket) take(size int) {
+	if b.rate != 0 {
+		b.tokens -= float64(size)
+	}
+}
+
+// allow takes size bytes from the bucket.
+func (b *bucket) allow(size int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.refill(time.Now(), size) {
+		return false
+	}
+	b.take(size)
+	return true
+}
+
+// allowBoth takes size bytes from both buckets, or from neither when one of
+// them is short, so that a frame dropped by one limit does not use up the
+// other. Callers lock the buckets in the same order, device before domain.
+func allowBoth(first, second *bucket, size int) bool {
+	first.mutex.Lock()
+	defer first.mutex.Unlock()
+	second.mutex.Lock()
+	defer second.mutex.Unlock()
+
+	now := time.Now()
+	if !first.refill(now, size) || !second.refill(now, size) {
+		return false
+	}
+	first.take(size)
+	second.take(size)
+	return true
+}
+
+func effectiveRate(domain *Domain, device *Device) uint64 {
+	rate := domain.DeviceRate
+	if device.Rate != 0 {
+		rate = device.Rate
+	}
+	if device.overQuota && (rate == 0 || rate > quotaThrottleRate) {
+		rate = quotaThrottleRate
+	}
+	return rate
+}
+
+// allowTraffic applies the device and domain limits to a frame sent by device
+// and counts the frames that are dropped.
+func allowTraffic(domain *Domain, device *Device, size int) bool {
+	if allowBoth(&device.limiter, &domain.limiter, size) {
+		return true
+	}
+	device.Dropped++
+	metrics.rateDropped.Add(1)
+	return false
+}
+
+func UpdateDomainRate(name string, deviceRate, domainRate, broadcastRate uint64) error {
+	result := storage.Model(&Domain{Name: name}).Updates(map[string]interface{}{"device_rate": deviceRate, "domain_rate": domainRate, "broadcast_rate": broadcastRate})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		domain.DeviceRate = deviceRate
+		domain.DomainRate = domainRate
+		domain.BroadcastRate = broadcastRate
+		domain.limiter.setRate(domainRate)
+		for _, device := range domain.wsDeviceMap {
+			device.limiter.setRate(effectiveRate(domain, device))
+			device.storm.limiter.setRate(domain.BroadcastRate)
+		}
+	}
+	return nil
+}
+
+func UpdateDeviceRate(name, vmac string, rate uint64) error {
+	result := storage.Model(&Device{Domain: name, VMac: vmac}).Update("rate", rate)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("device not found")
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		for _, device := range domain.wsDeviceMap {
+			if device.VMac == vmac {
+				device.Rate = rate
+				device.limiter.setRate(effectiveRate(domain, device))
+			}
+		}
+	}
+	return nil
+}
@@ -58,5 +58,5 @@ func ip2CountryRegion(ip string) (country, region string) {
 
 func UpdateLocation(device *Device, ip string) {
 	device.Country, device.Region = ip2CountryRegion(ip)
-	storage.Save(device)
+	markDirty(device)
 }
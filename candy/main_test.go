@@ -0,0 +1,16 @@
+package candy
+
+import (
+	"os"
+	"testing"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func TestMain(m *testing.M) {
+	if err := storage.Open("file::memory:?cache=shared"); err != nil {
+		logger.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
@@ -4,8 +4,12 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"strconv"
+	"sync"
 	"time"
+
+	"github.com/lanthora/cucurbita/storage"
 )
 
 const (
@@ -15,57 +19,175 @@ const (
 	PEER      uint8 = 3
 	VMAC      uint8 = 4
 	DISCOVERY uint8 = 5
+	AUTH6     uint8 = 6
+	DHCP6     uint8 = 7
 	GENERAL   uint8 = 255
 )
 
+// Subtypes of GENERAL messages that are consumed by the server instead of
+// being relayed between clients.
+const (
+	ADVERTISE uint8 = 16
+	ROUTE     uint8 = 17
+	NOTICE    uint8 = 18
+	MIRROR    uint8 = 19
+)
+
 type AuthMessage struct {
-	Type      uint8    `struc:"uint8"`
-	IP        uint32   `struc:"uint32"`
-	Timestamp int64    `struc:"int64"`
-	Hash      [32]byte `struc:"[32]byte"`
+	Type      uint8
+	IP        uint32
+	Timestamp int64
+	Hash      [32]byte
 }
 
 type ForwardMessage struct {
-	Type   uint8    `struc:"uint8"`
-	Unused [12]byte `struc:"[12]byte"`
-	Src    uint32   `struc:"uint32"`
-	Dst    uint32   `struc:"uint32"`
+	Type   uint8
+	Unused [12]byte
+	Src    uint32
+	Dst    uint32
+}
+
+type Forward6Message struct {
+	Type   uint8
+	Unused [8]byte
+	Src    [16]byte
+	Dst    [16]byte
 }
 
 type DHCPMessage struct {
-	Type      uint8    `struc:"uint8"`
-	Timestamp int64    `struc:"int64"`
-	Cidr      []byte   `struc:"[32]byte"`
-	Hash      [32]byte `struc:"[32]byte"`
+	Type      uint8
+	Timestamp int64
+	Cidr      []byte // 32 bytes, padded with zeros
+	Hash      [32]byte
 }
 
 type PeerConnMessage struct {
-	Type uint8  `struc:"uint8"`
-	Src  uint32 `struc:"uint32"`
-	Dst  uint32 `struc:"uint32"`
-	IP   uint32 `struc:"uint32"`
-	Port uint16 `struc:"uint16"`
+	Type uint8
+	Src  uint32
+	Dst  uint32
+	IP   uint32
+	Port uint16
 }
 
 type VMacMessage struct {
-	Type      uint8    `struc:"uint8"`
-	VMac      string   `struc:"[16]byte"`
-	Timestamp int64    `struc:"int64"`
-	Hash      [32]byte `struc:"[32]byte"`
+	Type      uint8
+	VMac      string // 16 bytes
+	Timestamp int64
+	Hash      [32]byte
 }
 
 type DiscoveryMessage struct {
-	Type uint8  `struc:"uint8"`
-	Src  uint32 `struc:"uint32"`
-	Dst  uint32 `struc:"uint32"`
+	Type uint8
+	Src  uint32
+	Dst  uint32
 }
 
 type GeneralMessage struct {
-	Type    uint8  `struc:"uint8"`
-	Subtype uint8  `struc:"uint8"`
-	Extra   uint16 `struc:"uint16"`
-	Src     uint32 `struc:"uint32"`
-	Dst     uint32 `struc:"uint32"`
+	Type    uint8
+	Subtype uint8
+	Extra   uint16
+	Src     uint32
+	Dst     uint32
+}
+
+type RouteEntry struct {
+	Gateway uint32
+	NetID   uint32
+	Mask    uint32
+}
+
+type RouteMessage struct {
+	Type    uint8
+	Subtype uint8
+	Size    uint16 // number of entries
+	Src     uint32
+	Dst     uint32
+	Entries []RouteEntry
+}
+
+type Auth6Message struct {
+	Type      uint8
+	IP        [16]byte
+	Timestamp int64
+	Hash      [32]byte
+}
+
+type DHCP6Message struct {
+	Type      uint8
+	Timestamp int64
+	Cidr      []byte // 64 bytes, padded with zeros
+	Hash      [32]byte
+}
+
+// Control messages are accepted when their timestamp is within this many
+// seconds of the server clock, unless the domain configures another window.
+const defaultSkew = 30
+
+var errReplay = errors.New("replayed message")
+
+// replayCache remembers the hashes of accepted control messages for as long
+// as their timestamps are inside the skew window, so that a captured message
+// cannot be accepted a second time. Hashes are kept in buckets by timestamp,
+// so that they expire a second at a time, and keyed by the sender's vmac
+// because devices sharing the domain password send identical DHCP messages
+// when they ask within the same second.
+type replayCache struct {
+	mutex   sync.Mutex
+	buckets map[int64]map[[32]byte]bool
+}
+
+func (c *replayCache) check(hash [32]byte, vmac string, timestamp, skew int64) error {
+	key := sha256.Sum256(append(hash[:], vmac...))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now().Unix()
+	for ts := range c.buckets {
+		if absInt64(now, ts) > skew {
+			delete(c.buckets, ts)
+		}
+	}
+
+	bucket := c.buckets[timestamp]
+	if bucket[key] {
+		return errReplay
+	}
+	if bucket == nil {
+		if c.buckets == nil {
+			c.buckets = make(map[int64]map[[32]byte]bool)
+		}
+		bucket = make(map[[32]byte]bool)
+		c.buckets[timestamp] = bucket
+	}
+	bucket[key] = true
+	return nil
+}
+
+func skew(domain *Domain) int64 {
+	if domain.Skew > 0 {
+		return domain.Skew
+	}
+	return defaultSkew
+}
+
+func UpdateSkew(name string, skew int64) error {
+	if skew < 0 {
+		return errors.New("invalid skew")
+	}
+	if result := storage.Model(&Domain{Name: name}).Update("skew", skew); result.Error != nil {
+		return result.Error
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		domain.Skew = skew
+	}
+	return nil
 }
 
 func absInt64(a, b int64) int64 {
@@ -75,44 +197,52 @@ func absInt64(a, b int64) int64 {
 	return b - a
 }
 
-func checkAuthMessage(domain *Domain, message *AuthMessage) error {
-	if absInt64(time.Now().Unix(), message.Timestamp) > 30 {
-		return errors.New("invalid auth message timestamp")
+func checkAuthMessage(domain *Domain, ws *Websocket, message *AuthMessage) error {
+	if absInt64(time.Now().Unix(), message.Timestamp) > skew(domain) {
+		return reject(CLOCKSKEW, errors.New("invalid auth message timestamp"))
 	}
 
 	reported := message.Hash
 
 	var data []byte
-	data = append(data, domain.Password...)
+	data = append(data, ws.secret...)
 	data = binary.BigEndian.AppendUint32(data, message.IP)
 	data = binary.BigEndian.AppendUint64(data, uint64(message.Timestamp))
 
 	if sha256.Sum256([]byte(data)) != reported {
-		return errors.New("auth hash value does not match")
+		return reject(UNAUTHORIZED, errors.New("auth hash value does not match"))
+	}
+
+	if err := domain.replay.check(reported, ws.vmac, message.Timestamp, skew(domain)); err != nil {
+		return fmt.Errorf("auth message: %w", err)
 	}
 	return nil
 }
 
-func checkDHCPMessage(domain *Domain, message *DHCPMessage) error {
-	if absInt64(time.Now().Unix(), message.Timestamp) > 30 {
-		return errors.New("invalid dhcp message timestamp")
+func checkDHCPMessage(domain *Domain, ws *Websocket, message *DHCPMessage) error {
+	if absInt64(time.Now().Unix(), message.Timestamp) > skew(domain) {
+		return reject(CLOCKSKEW, errors.New("invalid dhcp message timestamp"))
 	}
 
 	reported := message.Hash
 
 	var data []byte
-	data = append(data, domain.Password...)
+	data = append(data, ws.secret...)
 	data = binary.BigEndian.AppendUint64(data, uint64(message.Timestamp))
 
 	if sha256.Sum256([]byte(data)) != reported {
-		return errors.New("dhcp hash value does not match")
+		return reject(UNAUTHORIZED, errors.New("dhcp hash value does not match"))
+	}
+
+	if err := domain.replay.check(reported, ws.vmac, message.Timestamp, skew(domain)); err != nil {
+		return fmt.Errorf("dhcp message: %w", err)
 	}
 	return nil
 }
 
-func checkVMacMessage(domain *Domain, message *VMacMessage) error {
-	if absInt64(time.Now().Unix(), message.Timestamp) > 30 {
-		return errors.New("invalid vmac message timestamp")
+func checkVMacMessage(domain *Domain, ws *Websocket, secret string, message *VMacMessage) error {
+	if absInt64(time.Now().Unix(), message.Timestamp) > skew(domain) {
+		return reject(CLOCKSKEW, errors.New("invalid vmac message timestamp"))
 	}
 
 	if _, err := strconv.ParseUint(message.VMac, 16, 64); err != nil {
@@ -122,12 +252,59 @@ func checkVMacMessage(domain *Domain, message *VMacMessage) error {
 	reported := message.Hash
 
 	var data []byte
-	data = append(data, domain.Password...)
+	data = append(data, secret...)
 	data = append(data, message.VMac...)
 	data = binary.BigEndian.AppendUint64(data, uint64(message.Timestamp))
 
 	if sha256.Sum256([]byte(data)) != reported {
-		return errors.New("vmac hash value does not match")
+		return reject(UNAUTHORIZED, errors.New("vmac hash value does not match"))
+	}
+
+	if err := domain.replay.check(reported, message.VMac, message.Timestamp, skew(domain)); err != nil {
+		return fmt.Errorf("vmac message: %w", err)
+	}
+	return nil
+}
+
+func checkAuth6Message(domain *Domain, ws *Websocket, message *Auth6Message) error {
+	if absInt64(time.Now().Unix(), message.Timestamp) > skew(domain) {
+		return reject(CLOCKSKEW, errors.New("invalid auth6 message timestamp"))
+	}
+
+	reported := message.Hash
+
+	var data []byte
+	data = append(data, ws.secret...)
+	data = append(data, message.IP[:]...)
+	data = binary.BigEndian.AppendUint64(data, uint64(message.Timestamp))
+
+	if sha256.Sum256([]byte(data)) != reported {
+		return reject(UNAUTHORIZED, errors.New("auth6 hash value does not match"))
+	}
+
+	if err := domain.replay.check(reported, ws.vmac, message.Timestamp, skew(domain)); err != nil {
+		return fmt.Errorf("auth6 message: %w", err)
+	}
+	return nil
+}
+
+func checkDHCP6Message(domain *Domain, ws *Websocket, message *DHCP6Message) error {
+	if absInt64(time.Now().Unix(), message.Timestamp) > skew(domain) {
+		return reject(CLOCKSKEW, errors.New("invalid dhcp6 message timestamp"))
+	}
+
+	reported := message.Hash
+
+	var data []byte
+	data = append(data, ws.secret...)
+	data = binary.BigEndian.AppendUint64(data, uint64(message.Timestamp))
+
+	if sha256.Sum256([]byte(data)) != reported {
+		return reject(UNAUTHORIZED, errors.New("dhcp6 hash value does not match"))
+	}
+
+	if err := domain.replay.check(reported, ws.vmac, message.Timestamp, skew(domain)); err != nil {
+		return fmt.Errorf("dhcp6 message: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,186 @@
+package candy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+
+	"github.com/lanthora/cucurbita/storage"
+)
+
+// metrics holds the process wide counters exported by WriteMetrics. They are
+// updated with atomics so the relay path never waits on them.
+var metrics struct {
+	received      [256]atomic.Uint64
+	receivedBytes [256]atomic.Uint64
+	sent          [256]atomic.Uint64
+	sentBytes     [256]atomic.Uint64
+
+	broadcasts          atomic.Uint64
+	broadcastDeliveries atomic.Uint64
+
+	queueDropped  atomic.Uint64
+	rateDropped   atomic.Uint64
+	stormDropped  atomic.Uint64
+	bridgeDropped atomic.Uint64
+	storms        atomic.Uint64
+
+	mirrored      atomic.Uint64
+	mirrorDropped atomic.Uint64
+
+	rejections [OVERQUOTA + 1]atomic.Uint64
+	replays    atomic.Uint64
+
+	dhcp  atomic.Uint64
+	dhcp6 atomic.Uint64
+
+	connects    atomic.Uint64
+	disconnects atomic.Uint64
+}
+
+var messageTypeNames = map[uint8]string{
+	AUTH:      "auth",
+	FORWARD:   "forward",
+	DHCP:      "dhcp",
+	PEER:      "peer",
+	VMAC:      "vmac",
+	DISCOVERY: "discovery",
+	AUTH6:     "auth6",
+	DHCP6:     "dhcp6",
+	GENERAL:   "general",
+}
+
+var reasonNames = map[uint16]string{
+	UNAUTHORIZED: "unauthorized",
+	CLOCKSKEW:    "clock_skew",
+	OUTDATED:     "outdated",
+	BANNED:       "banned",
+	REFUSED:      "refused",
+	EXHAUSTED:    "exhausted",
+	OVERQUOTA:    "over_quota",
+}
+
+// RejectionName returns the name under which a rejection reason is counted,
+// which is also the reason recorded for the session it ended.
+func RejectionName(reason uint16) string {
+	return reasonNames[reason]
+}
+
+func countReceived(buffer []byte) {
+	metrics.received[buffer[0]].Add(1)
+	metrics.receivedBytes[buffer[0]].Add(uint64(len(buffer)))
+}
+
+func countSent(buffer []byte) {
+	metrics.sent[buffer[0]].Add(1)
+	metrics.sentBytes[buffer[0]].Add(uint64(len(buffer)))
+}
+
+func countRejection(reason uint16) {
+	if int(reason) < len(metrics.rejections) {
+		metrics.rejections[reason].Add(1)
+	}
+}
+
+// WriteMetrics writes the metrics in the Prometheus text exposition format.
+func WriteMetrics(w io.Writer) {
+	writeHeader := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	}
+
+	online := onlineDevices()
+	names := make([]string, 0, len(online))
+	for name := range online {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeHeader("cucurbita_online_devices", "gauge", "Devices currently online.")
+	for _, name := range names {
+		fmt.Fprintf(w, "cucurbita_online_devices{domain=%q} %v\n", name, online[name])
+	}
+
+	types := make([]int, 0, len(messageTypeNames))
+	for t := range messageTypeNames {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+
+	writeByType := func(name, help string, counters *[256]atomic.Uint64) {
+		writeHeader(name, "counter", help)
+		for _, t := range types {
+			fmt.Fprintf(w, "%v{type=%q} %v\n", name, messageTypeNames[uint8(t)], counters[t].Load())
+		}
+	}
+	writeByType("cucurbita_received_frames_total", "Frames received from clients by message type.", &metrics.received)
+	writeByType("cucurbita_received_bytes_total", "Bytes received from clients by message type.", &metrics.receivedBytes)
+	writeByType("cucurbita_sent_frames_total", "Frames queued to clients by message type.", &metrics.sent)
+	writeByType("cucurbita_sent_bytes_total", "Bytes queued to clients by message type.", &metrics.sentBytes)
+
+	writeHeader("cucurbita_broadcasts_total", "counter", "Frames relayed to every device of a domain.")
+	fmt.Fprintf(w, "cucurbita_broadcasts_total %v\n", metrics.broadcasts.Load())
+	writeHeader("cucurbita_broadcast_deliveries_total", "counter", "Copies sent while relaying broadcasts.")
+	fmt.Fprintf(w, "cucurbita_broadcast_deliveries_total %v\n", metrics.broadcastDeliveries.Load())
+
+	writeHeader("cucurbita_dropped_frames_total", "counter", "Frames dropped by the rate limiter, the broadcast limit, a full send queue or an unreachable bridge peer.")
+	fmt.Fprintf(w, "cucurbita_dropped_frames_total{reason=\"rate\"} %v\n", metrics.rateDropped.Load())
+	fmt.Fprintf(w, "cucurbita_dropped_frames_total{reason=\"broadcast\"} %v\n", metrics.stormDropped.Load())
+	fmt.Fprintf(w, "cucurbita_dropped_frames_total{reason=\"queue\"} %v\n", metrics.queueDropped.Load())
+	fmt.Fprintf(w, "cucurbita_dropped_frames_total{reason=\"bridge\"} %v\n", metrics.bridgeDropped.Load())
+	writeHeader("cucurbita_broadcast_storms_total", "counter", "Devices muted for flooding broadcasts.")
+	fmt.Fprintf(w, "cucurbita_broadcast_storms_total %v\n", metrics.storms.Load())
+
+	writeHeader("cucurbita_rejections_total", "counter", "Clients turned away by reason.")
+	for reason := UNAUTHORIZED; reason <= OVERQUOTA; reason++ {
+		fmt.Fprintf(w, "cucurbita_rejections_total{reason=%q} %v\n", reasonNames[reason], metrics.rejections[reason].Load())
+	}
+	fmt.Fprintf(w, "cucurbita_rejections_total{reason=\"replay\"} %v\n", metrics.replays.Load())
+
+	writeHeader("cucurbita_mirrored_frames_total", "counter", "Frames copied to monitoring devices.")
+	fmt.Fprintf(w, "cucurbita_mirrored_frames_total %v\n", metrics.mirrored.Load())
+	writeHeader("cucurbita_mirror_dropped_frames_total", "counter", "Copies dropped by the mirror rate limit.")
+	fmt.Fprintf(w, "cucurbita_mirror_dropped_frames_total %v\n", metrics.mirrorDropped.Load())
+
+	writeHeader("cucurbita_dhcp_allocations_total", "counter", "Addresses handed out to clients.")
+	fmt.Fprintf(w, "cucurbita_dhcp_allocations_total{family=\"ipv4\"} %v\n", metrics.dhcp.Load())
+	fmt.Fprintf(w, "cucurbita_dhcp_allocations_total{family=\"ipv6\"} %v\n", metrics.dhcp6.Load())
+
+	writeHeader("cucurbita_websocket_connects_total", "counter", "Websocket connections accepted.")
+	fmt.Fprintf(w, "cucurbita_websocket_connects_total %v\n", metrics.connects.Load())
+	writeHeader("cucurbita_websocket_disconnects_total", "counter", "Websocket connections closed.")
+	fmt.Fprintf(w, "cucurbita_websocket_disconnects_total %v\n", metrics.disconnects.Load())
+
+	latencies := storage.Latencies()
+	operations := make([]string, 0, len(latencies))
+	for operation := range latencies {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	writeHeader("cucurbita_storage_seconds", "summary", "Time spent in database operations.")
+	for _, operation := range operations {
+		latency := latencies[operation]
+		fmt.Fprintf(w, "cucurbita_storage_seconds_sum{operation=%q} %v\n", operation, latency.Seconds)
+		fmt.Fprintf(w, "cucurbita_storage_seconds_count{operation=%q} %v\n", operation, latency.Count)
+	}
+}
+
+func onlineDevices() map[string]int {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	result := make(map[string]int)
+	for name, domain := range nameDomainMap {
+		domain.mutex.RLock()
+		online := 0
+		for _, device := range domain.wsDeviceMap {
+			if device.Online {
+				online++
+			}
+		}
+		domain.mutex.RUnlock()
+		result[name] = online
+	}
+	return result
+}
@@ -0,0 +1,110 @@
+package candy
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/lanthora/cucurbita/storage"
+)
+
+// Frames copied to the monitor of a domain are limited to MirrorRate bytes
+// per second, or defaultMirrorRate when the domain does not set one, so that
+// mirroring never starves the monitor of its own traffic.
+const defaultMirrorRate = 1024 * 1024
+
+func effectiveMirrorRate(domain *Domain) uint64 {
+	if domain.MirrorRate != 0 {
+		return domain.MirrorRate
+	}
+	return defaultMirrorRate
+}
+
+func parseMirroredDevices(input string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	for _, vmac := range strings.Split(input, ",") {
+		vmac = strings.TrimSpace(vmac)
+		if vmac == "" {
+			continue
+		}
+		if _, err := strconv.ParseUint(vmac, 16, 64); err != nil || len(vmac) != 16 {
+			return nil, errors.New("invalid mirrored vmac: " + vmac)
+		}
+		result[vmac] = true
+	}
+	return result, nil
+}
+
+func loadMirror(domain *Domain) {
+	domain.mirrored, _ = parseMirroredDevices(domain.MirroredDevices)
+	domain.mirrorLimiter.setRate(effectiveMirrorRate(domain))
+}
+
+// mirrorFrame copies a FORWARD frame that src delivered to dst, which is nil
+// when the frame went to several devices or to another domain, to the monitor
+// of the domain when either of them is mirrored. The copy is a MIRROR message
+// carrying the virtual addresses followed by the IP packet, so that it is never
+// mistaken for traffic addressed to the monitor. IPv6 packets are annotated
+// with the IPv4 addresses of the devices, and multicast ones with the
+// broadcast address of the domain.
+func mirrorFrame(domain *Domain, src, dst *Device, buffer []byte) {
+	if domain.Monitor == "" || !domain.mirrored[src.VMac] && (dst == nil || !domain.mirrored[dst.VMac]) {
+		return
+	}
+
+	monitorWs, monitor := findOnlineDevice(domain, domain.Monitor)
+	if monitorWs == nil || monitor == src || monitor == dst {
+		return
+	}
+
+	packet := buffer[1:]
+	srcIP, dstIP := binary.BigEndian.Uint32(packet[12:16]), binary.BigEndian.Uint32(packet[16:20])
+	if packet[0]>>4 == 6 {
+		srcIP, dstIP = src.ip, 0
+		if packet[24] == 0xFF {
+			dstIP = domain.netID | ^domain.mask
+		} else if dst != nil {
+			dstIP = dst.ip
+		}
+	}
+
+	header, _ := (&GeneralMessage{Type: GENERAL, Subtype: MIRROR, Src: srcIP, Dst: dstIP}).MarshalBinary()
+	frame := append(header, buffer[1:]...)
+
+	if !domain.mirrorLimiter.allow(len(frame)) {
+		metrics.mirrorDropped.Add(1)
+		return
+	}
+	if monitorWs.WriteMessage(frame) == nil {
+		monitor.RX += uint64(len(frame))
+		metrics.mirrored.Add(1)
+	}
+}
+
+func UpdateMirror(name, monitor, devices string, rate uint64) error {
+	if _, err := strconv.ParseUint(monitor, 16, 64); monitor != "" && (err != nil || len(monitor) != 16) {
+		return errors.New("invalid monitor vmac: " + monitor)
+	}
+	if _, err := parseMirroredDevices(devices); err != nil {
+		return err
+	}
+
+	result := storage.Model(&Domain{Name: name}).Updates(map[string]interface{}{"monitor": monitor, "mirrored_devices": devices, "mirror_rate": rate})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		domain.Monitor = monitor
+		domain.MirroredDevices = devices
+		domain.MirrorRate = rate
+		loadMirror(domain)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package candy
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestMirrorFrame(t *testing.T) {
+	const (
+		sender    = "000000000000000a"
+		receiver  = "000000000000000b"
+		denied    = "000000000000000c"
+		monitored = "000000000000000d"
+	)
+
+	domain := newTestDomain(t, "10.0.0.0/24", SEQUENTIAL)
+	domain.Broadcast = true
+	domain.ip6WsMap = make(map[[16]byte]*Websocket)
+	domain.Monitor = monitored
+	domain.mirrored = map[string]bool{receiver: true, denied: true}
+	domain.rules = []rule{{src: endpoint{any: true}, dst: endpoint{vmac: denied}}}
+
+	devices := make(map[string]*Device)
+	for idx, vmac := range []string{sender, receiver, denied, monitored} {
+		ip := domain.netID | uint32(idx+1)
+		connect(domain, vmac, ip)
+		ws := domain.ipWsMap[ip]
+		ws.queue = make(chan []byte, 8)
+		device := domain.wsDeviceMap[ws]
+		device.ip6 = [16]byte{0xfd, 15: byte(idx + 1)}
+		domain.ip6WsMap[device.ip6] = ws
+		devices[vmac] = device
+	}
+	monitor := domain.ipWsMap[devices[monitored].ip]
+
+	frame := func(dst uint32) []byte {
+		buffer := make([]byte, forwardMessageSize)
+		buffer[0] = FORWARD
+		buffer[1] = 0x45
+		binary.BigEndian.PutUint32(buffer[13:], devices[sender].ip)
+		binary.BigEndian.PutUint32(buffer[17:], dst)
+		return buffer
+	}
+	frame6 := func(dst [16]byte) []byte {
+		buffer := make([]byte, forward6MessageSize)
+		buffer[0] = FORWARD
+		buffer[1] = 0x60
+		copy(buffer[9:], devices[sender].ip6[:])
+		copy(buffer[25:], dst[:])
+		return buffer
+	}
+
+	tests := []struct {
+		name     string
+		buffer   []byte
+		mirrored bool
+		src, dst uint32
+	}{
+		{"unicast to a mirrored device", frame(devices[receiver].ip), true, devices[sender].ip, devices[receiver].ip},
+		{"unicast denied by a rule", frame(devices[denied].ip), false, 0, 0},
+		{"broadcast reaching a mirrored device", frame(domain.netID | 0xFF), true, devices[sender].ip, domain.netID | 0xFF},
+		{"ipv6 unicast", frame6(devices[receiver].ip6), true, devices[sender].ip, devices[receiver].ip},
+		{"ipv6 multicast", frame6([16]byte{0xff, 0x02, 15: 1}), true, devices[sender].ip, domain.netID | 0xFF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, ws := range domain.ipWsMap {
+				for len(ws.queue) != 0 {
+					<-ws.queue
+				}
+			}
+			domain.mirrorLimiter.setRate(0)
+
+			if err := handleForwardMessage(domain.ipWsMap[devices[sender].ip], domain, tt.buffer); err != nil {
+				t.Fatal(err)
+			}
+
+			var copies []GeneralMessage
+			for len(monitor.queue) != 0 {
+				output := <-monitor.queue
+				message := GeneralMessage{}
+				if message.UnmarshalBinary(output) == nil && message.Type == GENERAL && message.Subtype == MIRROR {
+					copies = append(copies, message)
+				}
+			}
+
+			if !tt.mirrored {
+				if len(copies) != 0 {
+					t.Fatalf("got %v mirrored copies, want none", len(copies))
+				}
+				return
+			}
+			if len(copies) != 1 {
+				t.Fatalf("got %v mirrored copies, want 1", len(copies))
+			}
+			if copies[0].Src != tt.src || copies[0].Dst != tt.dst {
+				t.Errorf("got annotation %v -> %v, want %v -> %v", uint32ToIpString(copies[0].Src), uint32ToIpString(copies[0].Dst), uint32ToIpString(tt.src), uint32ToIpString(tt.dst))
+			}
+		})
+	}
+}
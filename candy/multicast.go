@@ -0,0 +1,232 @@
+package candy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+// Groups flooded to every device when the domain does not configure its own
+// list: the link-local control block, which includes mDNS and the IGMP queries
+// themselves, and SSDP.
+const defaultFloodGroups = "224.0.0.0/24,239.255.255.250"
+
+const (
+	igmpV1Report = 0x12
+	igmpV2Report = 0x16
+	igmpV2Leave  = 0x17
+	igmpV3Report = 0x22
+)
+
+// multicastGroups is the membership learned by snooping IGMP. The server sends
+// no queries, so a membership lasts until the device leaves the group or
+// disconnects. It has its own lock because it changes while relaying under the
+// read lock of the domain.
+type multicastGroups struct {
+	mutex   sync.Mutex
+	members map[uint32]map[*Websocket]bool
+}
+
+type network struct {
+	netID uint32
+	mask  uint32
+}
+
+func parseFloodGroups(input string) ([]network, error) {
+	if strings.TrimSpace(input) == "" {
+		input = defaultFloodGroups
+	}
+
+	var result []network
+	for _, item := range strings.Split(input, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			item += "/32"
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil || ipNet.IP.To4() == nil || !isMulticast(binary.BigEndian.Uint32(ipNet.IP.To4())) {
+			return nil, errors.New("invalid multicast group: " + item)
+		}
+		result = append(result, network{netID: binary.BigEndian.Uint32(ipNet.IP.To4()), mask: binary.BigEndian.Uint32(ipNet.Mask)})
+	}
+	return result, nil
+}
+
+func CheckFloodGroups(input string) error {
+	_, err := parseFloodGroups(input)
+	return err
+}
+
+func loadFloodGroups(domain *Domain) {
+	groups, err := parseFloodGroups(domain.FloodGroups)
+	if err != nil {
+		logger.Debug(err)
+		groups, _ = parseFloodGroups(defaultFloodGroups)
+	}
+	domain.floodGroups = groups
+}
+
+func UpdateFloodGroups(name, groups string) error {
+	if err := CheckFloodGroups(groups); err != nil {
+		return err
+	}
+	if result := storage.Model(&Domain{Name: name}).Update("flood_groups", groups); result.Error != nil {
+		return result.Error
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		domain.FloodGroups = groups
+		loadFloodGroups(domain)
+	}
+	return nil
+}
+
+func isMulticast(ip uint32) bool {
+	return ip&0xF0000000 == 0xE0000000
+}
+
+func isFlooded(domain *Domain, group uint32) bool {
+	for _, n := range domain.floodGroups {
+		if group&n.mask == n.netID {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *multicastGroups) join(group uint32, ws *Websocket) {
+	if !isMulticast(group) {
+		return
+	}
+	if g.members == nil {
+		g.members = make(map[uint32]map[*Websocket]bool)
+	}
+	if g.members[group] == nil {
+		g.members[group] = make(map[*Websocket]bool)
+	}
+	g.members[group][ws] = true
+}
+
+func (g *multicastGroups) leave(group uint32, ws *Websocket) {
+	delete(g.members[group], ws)
+	if len(g.members[group]) == 0 {
+		delete(g.members, group)
+	}
+}
+
+// remove drops every membership of a closed connection.
+func (g *multicastGroups) remove(ws *Websocket) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for group := range g.members {
+		g.leave(group, ws)
+	}
+}
+
+// subscribers returns the members of group.
+func (g *multicastGroups) subscribers(group uint32) []*Websocket {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var result []*Websocket
+	for ws := range g.members[group] {
+		result = append(result, ws)
+	}
+	return result
+}
+
+// snoopIGMP updates the membership of ws from an IGMP report or leave carried
+// in a FORWARD frame. Other frames are ignored.
+func snoopIGMP(domain *Domain, ws *Websocket, buffer []byte) {
+	packet := buffer[1:]
+	if len(packet) < 20 || packet[9] != 2 {
+		return
+	}
+	ihl := int(packet[0]&0x0F) * 4
+	if ihl < 20 || len(packet) < ihl+8 {
+		return
+	}
+	igmp := packet[ihl:]
+
+	g := &domain.groups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	switch igmp[0] {
+	case igmpV1Report, igmpV2Report:
+		g.join(binary.BigEndian.Uint32(igmp[4:]), ws)
+	case igmpV2Leave:
+		g.leave(binary.BigEndian.Uint32(igmp[4:]), ws)
+	case igmpV3Report:
+		records := int(binary.BigEndian.Uint16(igmp[6:]))
+		offset := 8
+		for idx := 0; idx < records && len(igmp) >= offset+8; idx++ {
+			recordType := igmp[offset]
+			auxLen := int(igmp[offset+1])
+			sources := int(binary.BigEndian.Uint16(igmp[offset+2:]))
+			group := binary.BigEndian.Uint32(igmp[offset+4:])
+
+			switch {
+			// an exclude filter, or an include filter with sources, receives
+			// the group; sources are not tracked
+			case recordType == 2 || recordType == 4:
+				g.join(group, ws)
+			case (recordType == 1 || recordType == 3 || recordType == 5) && sources > 0:
+				g.join(group, ws)
+			// change to include nothing is how IGMPv3 leaves a group
+			case recordType == 3 && sources == 0:
+				g.leave(group, ws)
+			}
+			offset += 8 + 4*sources + 4*auxLen
+		}
+	}
+}
+
+// forwardMulticast relays a multicast frame to the devices that joined its
+// group.
+func forwardMulticast(ws *Websocket, domain *Domain, device *Device, buffer []byte, src, group uint32) {
+	var seen fanout
+	for _, dstWs := range domain.groups.subscribers(group) {
+		dstDev, ok := domain.wsDeviceMap[dstWs]
+		if !ok || dstWs == ws || !dstDev.Online || !isAllowed(domain, device, src, dstDev, dstDev.ip) {
+			continue
+		}
+		if dstWs.WriteMessage(buffer) == nil {
+			dstDev.RX += uint64(len(buffer))
+			seen.add(domain, dstDev)
+		}
+	}
+	seen.observe(domain, device, buffer)
+}
+
+// MulticastGroups returns the number of devices subscribed to each group.
+func MulticastGroups(name string) map[string]int {
+	nameDomainMapMutex.RLock()
+	domain, ok := nameDomainMap[name]
+	nameDomainMapMutex.RUnlock()
+
+	result := make(map[string]int)
+	if !ok {
+		return result
+	}
+
+	domain.groups.mutex.Lock()
+	defer domain.groups.mutex.Unlock()
+	for group, members := range domain.groups.members {
+		result[uint32ToIpString(group)] = len(members)
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+package candy
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reasons for turning a client away. They are sent in the Extra field of a
+// NOTICE message and, when the connection is closed, as the close code offset
+// by closeCodeBase.
+const (
+	UNAUTHORIZED uint16 = 1
+	CLOCKSKEW    uint16 = 2
+	OUTDATED     uint16 = 3
+	BANNED       uint16 = 4
+	REFUSED      uint16 = 5
+	EXHAUSTED    uint16 = 6
+	OVERQUOTA    uint16 = 7
+)
+
+// Close codes from 4000 to 4999 are reserved for private use by RFC 6455.
+const closeCodeBase = 4000
+
+// A close frame carries at most 123 bytes of reason text.
+const maxCloseText = 123
+
+type rejection struct {
+	reason uint16
+	err    error
+}
+
+func (r *rejection) Error() string {
+	return r.err.Error()
+}
+
+func (r *rejection) Unwrap() error {
+	return r.err
+}
+
+// reject marks err as something the client should be told about.
+func reject(reason uint16, err error) error {
+	return &rejection{reason: reason, err: err}
+}
+
+// WriteNotice sends a NOTICE message whose Extra field is the reason, followed
+// by a human readable text.
+func (ws *Websocket) WriteNotice(reason uint16, text string) error {
+	header, err := (&GeneralMessage{Type: GENERAL, Subtype: NOTICE, Extra: reason}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return ws.writeNow(append(header, text...))
+}
+
+// Reject tells the client why it is turned away and closes the websocket with
+// a matching close code, so that clients which do not understand NOTICE
+// messages still see the reason.
+func (ws *Websocket) Reject(reason uint16, text string) error {
+	ws.setReason(reasonNames[reason])
+	ws.WriteNotice(reason, text)
+
+	if len(text) > maxCloseText {
+		text = text[:maxCloseText]
+	}
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	message := websocket.FormatCloseMessage(closeCodeBase+int(reason), text)
+	return ws.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+}
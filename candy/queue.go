@@ -0,0 +1,82 @@
+package candy
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lanthora/cucurbita/logger"
+)
+
+const (
+	// Frames waiting for a slow receiver beyond this are dropped.
+	sendQueueSize = 256
+
+	// A single write that takes longer than this closes the connection.
+	writeTimeout = 10 * time.Second
+
+	// A receiver whose queue stays full for this long is disconnected.
+	stuckTimeout = 10 * time.Second
+)
+
+var errQueueFull = errors.New("send queue is full")
+
+func newWebsocket(conn *websocket.Conn) *Websocket {
+	ws := &Websocket{
+		conn:  conn,
+		queue: make(chan []byte, sendQueueSize),
+		done:  make(chan struct{}),
+	}
+	go ws.writeLoop()
+	return ws
+}
+
+// WriteMessage queues a frame for the writer goroutine without blocking, so a
+// slow receiver cannot stall the sender or the domain lock held while relaying.
+// The buffer must not be modified afterwards.
+func (ws *Websocket) WriteMessage(buffer []byte) error {
+	select {
+	case ws.queue <- buffer:
+		ws.stuckSince.Store(0)
+		countSent(buffer)
+		return nil
+	default:
+	}
+
+	ws.dropped.Add(1)
+	metrics.queueDropped.Add(1)
+	now := time.Now().UnixNano()
+	if !ws.stuckSince.CompareAndSwap(0, now) && now-ws.stuckSince.Load() > int64(stuckTimeout) {
+		logger.Debugf("send queue stuck, closing connection: remote=%v", ws.conn.RemoteAddr())
+		ws.closeFor(STUCK)
+	}
+	return errQueueFull
+}
+
+// writeNow writes a frame ahead of the queue. It is meant for the few messages
+// that must reach the client before the connection is closed.
+func (ws *Websocket) writeNow(buffer []byte) error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return ws.conn.WriteMessage(websocket.BinaryMessage, buffer)
+}
+
+func (ws *Websocket) writeLoop() {
+	for {
+		select {
+		case buffer := <-ws.queue:
+			if err := ws.writeNow(buffer); err != nil {
+				ws.conn.Close()
+				return
+			}
+		case <-ws.done:
+			return
+		}
+	}
+}
+
+// close stops the writer goroutine. Frames still queued are discarded.
+func (ws *Websocket) close() {
+	close(ws.done)
+}
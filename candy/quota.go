@@ -0,0 +1,286 @@
+package candy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+	"gorm.io/gorm"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Usage{})
+	})
+}
+
+const (
+	THROTTLE   = "throttle"
+	DISCONNECT = "disconnect"
+)
+
+// Devices over quota keep this much bandwidth when the domain throttles
+// instead of disconnecting.
+const quotaThrottleRate = 16 * 1024
+
+// Usage archives the traffic of a device during one finished quota period.
+type Usage struct {
+	ID        uint `gorm:"primaryKey"`
+	Domain    string
+	VMac      string
+	StartedAt time.Time
+	EndedAt   time.Time
+	RX        uint64
+	TX        uint64
+}
+
+// periodEnd returns the end of the current period. A zero QuotaPeriod means
+// calendar months, otherwise it is the period length in days.
+func periodEnd(domain *Domain) time.Time {
+	if domain.QuotaPeriod > 0 {
+		return domain.PeriodStartedAt.AddDate(0, 0, domain.QuotaPeriod)
+	}
+	year, month, _ := domain.PeriodStartedAt.Date()
+	return time.Date(year, month+1, 1, 0, 0, 0, 0, time.Local)
+}
+
+func deviceQuota(domain *Domain, device *Device) uint64 {
+	if device.Quota != 0 {
+		return device.Quota
+	}
+	return domain.DeviceQuota
+}
+
+func isOverQuota(domain *Domain, device *Device) bool {
+	if domain.overQuota {
+		return true
+	}
+	quota := deviceQuota(domain, device)
+	return quota != 0 && device.RX+device.TX >= quota
+}
+
+// checkQuotaOnAuth refuses devices that were disconnected for exceeding their
+// quota and restores the throttle of the others. The caller rolled the period
+// over before loading the counters of device.
+func checkQuotaOnAuth(domain *Domain, device *Device) error {
+	device.overQuota = isOverQuota(domain, device)
+	if device.overQuota && domain.QuotaAction == DISCONNECT {
+		return reject(OVERQUOTA, errors.New("traffic quota exceeded"))
+	}
+	device.limiter.setRate(effectiveRate(domain, device))
+	return nil
+}
+
+// runQuotas checks the quotas of the loaded domains every minute until ctx is
+// done. Domains nobody connected to yet are checked once they are loaded.
+func runQuotas(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, domain := range loadedDomains() {
+				checkQuota(domain)
+			}
+		}
+	}
+}
+
+func checkQuota(domain *Domain) {
+	rollPeriod(domain)
+
+	used := uint64(0)
+	storage.Model(&Device{}).Where("domain = ? AND online = false", domain.Name).Select("COALESCE(SUM(rx + tx), 0)").Scan(&used)
+
+	var rejected []*Websocket
+	domain.mutex.Lock()
+	for _, device := range domain.wsDeviceMap {
+		if device.Online {
+			used += device.RX + device.TX
+		}
+	}
+	domain.overQuota = domain.DomainQuota != 0 && used >= domain.DomainQuota
+
+	for ws, device := range domain.wsDeviceMap {
+		if !device.Online {
+			continue
+		}
+		overQuota := isOverQuota(domain, device)
+		if overQuota && domain.QuotaAction == DISCONNECT {
+			logger.Debugf("quota exceeded: domain=%v vmac=%v", domain.Name, device.VMac)
+			rejected = append(rejected, ws)
+			continue
+		}
+		if overQuota != device.overQuota {
+			device.overQuota = overQuota
+			device.limiter.setRate(effectiveRate(domain, device))
+		}
+	}
+	domain.mutex.Unlock()
+
+	for _, ws := range rejected {
+		ws.Reject(OVERQUOTA, "traffic quota exceeded")
+		ws.conn.Close()
+	}
+}
+
+func periodEnded(domain *Domain) bool {
+	domain.mutex.RLock()
+	defer domain.mutex.RUnlock()
+	return domain.PeriodStartedAt.IsZero() || !time.Now().Before(periodEnd(domain))
+}
+
+// rollPeriod starts the periods that ended since it last ran. Devices of the
+// domain are not loaded until it returns, so that none of them picks up the
+// counters it archives, and nothing is synced meanwhile, so that the archived
+// counters are not written back.
+func rollPeriod(domain *Domain) {
+	if !periodEnded(domain) {
+		return
+	}
+
+	domain.period.Lock()
+	defer domain.period.Unlock()
+
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+	syncLocked()
+
+	domain.mutex.Lock()
+	started := domain.PeriodStartedAt
+	if started.IsZero() {
+		year, month, _ := time.Now().Date()
+		domain.PeriodStartedAt = time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
+	}
+	domain.mutex.Unlock()
+
+	if started.IsZero() {
+		storage.Model(&Domain{Name: domain.Name}).Update("period_started_at", domain.PeriodStartedAt)
+	}
+
+	for periodEnded(domain) {
+		domain.mutex.RLock()
+		end := periodEnd(domain)
+		domain.mutex.RUnlock()
+		resetPeriod(domain, end)
+	}
+}
+
+// resetPeriod archives the counters of every device in the domain and starts
+// the next period at end. The counters of online devices and of devices that
+// disconnected since the last sync are taken from memory under the domain lock,
+// the others are archived from storage after it is released. The caller holds
+// syncMutex.
+func resetPeriod(domain *Domain, end time.Time) {
+	var usages []Usage
+	var samples []Traffic
+	inMemory := make(map[string]bool)
+
+	domain.mutex.Lock()
+	started := domain.PeriodStartedAt
+	dirtyDevices.mutex.Lock()
+	for device := range dirtyDevices.m {
+		if device.Domain != domain.Name || device.Online {
+			continue
+		}
+		inMemory[device.VMac] = true
+		if device.RX+device.TX != 0 {
+			usages = append(usages, Usage{Domain: domain.Name, VMac: device.VMac, StartedAt: started, EndedAt: end, RX: device.RX, TX: device.TX})
+		}
+		device.RX = 0
+		device.TX = 0
+	}
+	dirtyDevices.mutex.Unlock()
+	for _, device := range domain.wsDeviceMap {
+		if !device.Online {
+			continue
+		}
+		inMemory[device.VMac] = true
+		if device.RX+device.TX != 0 {
+			usages = append(usages, Usage{Domain: domain.Name, VMac: device.VMac, StartedAt: started, EndedAt: end, RX: device.RX, TX: device.TX})
+		}
+		samples = append(samples, sampleDevice(domain, device, end))
+		device.RX = 0
+		device.TX = 0
+		markSampled(device)
+		device.overQuota = false
+		device.limiter.setRate(effectiveRate(domain, device))
+	}
+	domain.overQuota = false
+	domain.PeriodStartedAt = end
+	domain.mutex.Unlock()
+
+	saveTraffic(samples)
+
+	err := storage.Transaction(func(tx *gorm.DB) error {
+		var devices []Device
+		if result := tx.Where(&Device{Domain: domain.Name}).Find(&devices); result.Error != nil {
+			return result.Error
+		}
+		archived := usages
+		for idx := range devices {
+			device := &devices[idx]
+			if !inMemory[device.VMac] && device.RX+device.TX != 0 {
+				archived = append(archived, Usage{Domain: domain.Name, VMac: device.VMac, StartedAt: started, EndedAt: end, RX: device.RX, TX: device.TX})
+			}
+		}
+		for idx := range archived {
+			if result := tx.Create(&archived[idx]); result.Error != nil {
+				return result.Error
+			}
+		}
+		if result := tx.Model(&Device{}).Where("domain = ?", domain.Name).Updates(map[string]interface{}{"rx": 0, "tx": 0}); result.Error != nil {
+			return result.Error
+		}
+		return tx.Model(&Domain{Name: domain.Name}).Update("period_started_at", end).Error
+	})
+	if err != nil {
+		logger.Debug("reset period: ", err)
+	}
+}
+
+func UpdateDomainQuota(name string, deviceQuota, domainQuota uint64, period int, action string) error {
+	values := map[string]interface{}{"device_quota": deviceQuota, "domain_quota": domainQuota, "quota_period": period, "quota_action": action}
+	if result := storage.Model(&Domain{Name: name}).Updates(values); result.Error != nil {
+		return result.Error
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		domain.DeviceQuota = deviceQuota
+		domain.DomainQuota = domainQuota
+		domain.QuotaPeriod = period
+		domain.QuotaAction = action
+	}
+	return nil
+}
+
+func UpdateDeviceQuota(name, vmac string, quota uint64) error {
+	result := storage.Model(&Device{Domain: name, VMac: vmac}).Update("quota", quota)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		for _, device := range domain.wsDeviceMap {
+			if device.VMac == vmac {
+				device.Quota = quota
+			}
+		}
+	}
+	return nil
+}
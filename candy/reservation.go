@@ -0,0 +1,178 @@
+package candy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Reservation{})
+	})
+}
+
+type Reservation struct {
+	ID      uint `gorm:"primaryKey"`
+	Domain  string
+	VMac    string
+	Address string
+}
+
+type reservation struct {
+	vmac  string
+	first uint32
+	last  uint32
+}
+
+func ipToUint32(input string) (uint32, error) {
+	ip := net.ParseIP(strings.TrimSpace(input))
+	if ip == nil || ip.To4() == nil {
+		return 0, errors.New("invalid address: " + input)
+	}
+	return binary.BigEndian.Uint32(ip.To4()), nil
+}
+
+func parseReservation(record *Reservation) (reservation, error) {
+	result := reservation{vmac: strings.TrimSpace(record.VMac)}
+	address := strings.TrimSpace(record.Address)
+
+	if result.vmac != "" {
+		if _, err := strconv.ParseUint(result.vmac, 16, 64); err != nil || len(result.vmac) != 16 {
+			return reservation{}, errors.New("invalid reservation vmac: " + result.vmac)
+		}
+	}
+
+	switch {
+	case strings.Contains(address, "/"):
+		_, ipNet, err := net.ParseCIDR(address)
+		if err != nil || ipNet.IP.To4() == nil {
+			return reservation{}, errors.New("invalid reservation cidr: " + address)
+		}
+		result.first = binary.BigEndian.Uint32(ipNet.IP.To4())
+		result.last = result.first | ^binary.BigEndian.Uint32(ipNet.Mask)
+	case strings.Contains(address, "-"):
+		bounds := strings.SplitN(address, "-", 2)
+		first, err := ipToUint32(bounds[0])
+		if err != nil {
+			return reservation{}, err
+		}
+		last, err := ipToUint32(bounds[1])
+		if err != nil {
+			return reservation{}, err
+		}
+		if first > last {
+			return reservation{}, errors.New("invalid reservation range: " + address)
+		}
+		result.first, result.last = first, last
+	default:
+		ip, err := ipToUint32(address)
+		if err != nil {
+			return reservation{}, err
+		}
+		result.first, result.last = ip, ip
+	}
+
+	if result.vmac != "" && result.first != result.last {
+		return reservation{}, errors.New("vmac can only be bound to a single address: " + address)
+	}
+	return result, nil
+}
+
+// CheckReservation validates r against itself and the other reservations of
+// its domain. An address is pinned to at most one device, a device has at
+// most one pinned address, and pinned addresses stay out of excluded ranges.
+func CheckReservation(r *Reservation) error {
+	result, err := parseReservation(r)
+	if err != nil {
+		return err
+	}
+
+	var records []Reservation
+	storage.Where(&Reservation{Domain: r.Domain}).Find(&records)
+
+	for idx := range records {
+		other, err := parseReservation(&records[idx])
+		if err != nil {
+			continue
+		}
+		switch {
+		case result.vmac != "" && other.vmac != "" && other.first == result.first:
+			return errors.New("address is already reserved: " + records[idx].Address)
+		case result.vmac != "" && other.vmac == result.vmac:
+			return errors.New("vmac already has a reserved address: " + result.vmac)
+		case result.vmac != "" && other.vmac == "" && other.first <= result.first && result.first <= other.last:
+			return errors.New("address lies in an excluded range: " + records[idx].Address)
+		case result.vmac == "" && other.vmac != "" && result.first <= other.first && other.first <= result.last:
+			return errors.New("range contains a reserved address: " + records[idx].Address)
+		}
+	}
+	return nil
+}
+
+func loadReservations(domain *Domain) {
+	var records []Reservation
+	storage.Where(&Reservation{Domain: domain.Name}).Find(&records)
+
+	domain.reservations = nil
+	for idx := range records {
+		r, err := parseReservation(&records[idx])
+		if err != nil {
+			logger.Debug(err)
+			continue
+		}
+		if r.vmac != "" && domain.DHCP != "" && r.first&domain.mask != domain.netID {
+			logger.Debug("reservation address does not match network configuration: ", records[idx].Address)
+			continue
+		}
+		domain.reservations = append(domain.reservations, r)
+	}
+}
+
+func ReloadReservations(name string) {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		loadReservations(domain)
+	}
+}
+
+// reservedAddress returns the address pinned to vmac, if any.
+func reservedAddress(domain *Domain, vmac string) (uint32, bool) {
+	for idx := range domain.reservations {
+		if r := &domain.reservations[idx]; r.vmac != "" && r.vmac == vmac {
+			return r.first, true
+		}
+	}
+	return 0, false
+}
+
+// isReservedByOther reports whether ip is pinned to a device other than vmac.
+func isReservedByOther(domain *Domain, vmac string, ip uint32) bool {
+	for idx := range domain.reservations {
+		r := &domain.reservations[idx]
+		if r.vmac != "" && r.vmac != vmac && r.first == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcluded reports whether ip must not be handed out by dynamic allocation.
+func isExcluded(domain *Domain, ip uint32) bool {
+	for idx := range domain.reservations {
+		r := &domain.reservations[idx]
+		if r.first <= ip && ip <= r.last {
+			return true
+		}
+	}
+	return false
+}
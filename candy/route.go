@@ -0,0 +1,192 @@
+package candy
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+	"gorm.io/gorm"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Route{})
+	})
+}
+
+type Route struct {
+	ID       uint `gorm:"primaryKey"`
+	Domain   string
+	VMac     string
+	Prefix   string
+	Approved bool
+}
+
+type route struct {
+	vmac  string
+	netID uint32
+	mask  uint32
+}
+
+func loadRoutes(domain *Domain) {
+	var records []Route
+	storage.Where(&Route{Domain: domain.Name, Approved: true}).Find(&records)
+
+	domain.routes = nil
+	for _, record := range records {
+		e, err := parseEndpoint(record.Prefix)
+		if err != nil || e.any || e.vmac != "" || e.net6 != nil {
+			logger.Debug("invalid route prefix: ", record.Prefix)
+			continue
+		}
+		domain.routes = append(domain.routes, route{vmac: record.VMac, netID: e.netID, mask: e.mask})
+	}
+
+	sort.SliceStable(domain.routes, func(i, j int) bool {
+		return domain.routes[i].mask > domain.routes[j].mask
+	})
+}
+
+func ReloadRoutes(name string) {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		loadRoutes(domain)
+		broadcastRoutes(domain)
+	}
+}
+
+func findOnlineDevice(domain *Domain, vmac string) (*Websocket, *Device) {
+	ws, ok := domain.vmacWsMap[vmac]
+	if !ok {
+		return nil, nil
+	}
+	if device := domain.wsDeviceMap[ws]; device != nil && device.Online {
+		return ws, device
+	}
+	return nil, nil
+}
+
+// lookupRoute returns the online device advertising the longest prefix that
+// contains ip.
+func lookupRoute(domain *Domain, ip uint32) (*Websocket, *Device) {
+	for idx := range domain.routes {
+		r := &domain.routes[idx]
+		if ip&r.mask != r.netID {
+			continue
+		}
+		if ws, device := findOnlineDevice(domain, r.vmac); ws != nil {
+			return ws, device
+		}
+	}
+	return nil, nil
+}
+
+func hasRoutes(domain *Domain, vmac string) bool {
+	for idx := range domain.routes {
+		if domain.routes[idx].vmac == vmac {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRouteTable reports whether clients of the domain need a route table,
+// which avoids sending empty tables to clients of domains without routes.
+func hasRouteTable(domain *Domain) bool {
+	return len(domain.routes) != 0 || domain.ExitNode != "" || domain.BackupExitNode != ""
+}
+
+// isRoutedBy reports whether ip belongs to a prefix advertised by device, so
+// that hosts behind a gateway can send through it.
+func isRoutedBy(domain *Domain, device *Device, ip uint32) bool {
+	for idx := range domain.routes {
+		r := &domain.routes[idx]
+		if r.vmac == device.VMac && ip&r.mask == r.netID {
+			return true
+		}
+	}
+	return false
+}
+
+// A device may advertise at most maxAdvertisedRoutes prefixes, approved or
+// not, so that a client cannot fill the route table awaiting approval.
+const maxAdvertisedRoutes = 32
+
+// handleAdvertiseMessage records the prefixes a device advertises for approval.
+// It only runs on the reader of the device, which owns device.advertised.
+func handleAdvertiseMessage(domain *Domain, device *Device, buffer []byte) error {
+	message := &RouteMessage{}
+	if err := message.UnmarshalBinary(buffer); err != nil {
+		return err
+	}
+
+	if device.advertised == nil {
+		var records []Route
+		storage.Where(&Route{Domain: domain.Name, VMac: device.VMac}).Find(&records)
+		device.advertised = make(map[string]bool)
+		for _, record := range records {
+			device.advertised[record.Prefix] = true
+		}
+	}
+
+	for _, entry := range message.Entries {
+		if entry.Mask == 0 || entry.NetID&entry.Mask != entry.NetID {
+			return errors.New("invalid advertised route")
+		}
+		if mask := entry.Mask & domain.mask; domain.DHCP != "" && entry.NetID&mask == domain.netID&mask {
+			return errors.New("advertised route overlaps the domain network")
+		}
+
+		prefix := uint32ToCidrString(entry.NetID, entry.Mask)
+		if device.advertised[prefix] {
+			continue
+		}
+		if len(device.advertised) >= maxAdvertisedRoutes {
+			logger.Debugf("too many advertised routes: domain=%v vmac=%v", domain.Name, device.VMac)
+			return nil
+		}
+		device.advertised[prefix] = true
+
+		record := Route{Domain: domain.Name, VMac: device.VMac, Prefix: prefix}
+		queueWrite(func(tx *gorm.DB) error {
+			return tx.Where(&record).FirstOrCreate(&Route{}).Error
+		})
+	}
+	return nil
+}
+
+func pushRoutes(domain *Domain, ws *Websocket, device *Device) {
+	message := &RouteMessage{Type: GENERAL, Subtype: ROUTE, Dst: device.ip}
+	for idx := range domain.routes {
+		r := &domain.routes[idx]
+		if r.vmac == device.VMac {
+			continue
+		}
+		entry := RouteEntry{NetID: r.netID, Mask: r.mask}
+		if _, gateway := findOnlineDevice(domain, r.vmac); gateway != nil {
+			entry.Gateway = gateway.ip
+		}
+		message.Entries = append(message.Entries, entry)
+	}
+
+	if _, exit := exitNode(domain); exit != nil && exit != device {
+		message.Entries = append(message.Entries, RouteEntry{Gateway: exit.ip})
+	}
+
+	if output, err := message.MarshalBinary(); err == nil {
+		ws.WriteMessage(output)
+	}
+}
+
+func broadcastRoutes(domain *Domain) {
+	for ws, device := range domain.wsDeviceMap {
+		if device.Online && device.ip != 0 {
+			pushRoutes(domain, ws, device)
+		}
+	}
+}
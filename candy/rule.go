@@ -0,0 +1,166 @@
+package candy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Rule{})
+	})
+}
+
+type Rule struct {
+	ID       uint `gorm:"primaryKey"`
+	Domain   string
+	Priority int
+	Src      string
+	Dst      string
+	Allow    bool
+}
+
+type endpoint struct {
+	any   bool
+	vmac  string
+	netID uint32
+	mask  uint32
+	net6  *net.IPNet
+}
+
+type rule struct {
+	src   endpoint
+	dst   endpoint
+	allow bool
+}
+
+func parseEndpoint(input string) (endpoint, error) {
+	input = strings.TrimSpace(input)
+	if input == "" || input == "*" {
+		return endpoint{any: true}, nil
+	}
+
+	if strings.Contains(input, "/") {
+		_, ipNet, err := net.ParseCIDR(input)
+		if err != nil {
+			return endpoint{}, errors.New("invalid rule cidr: " + input)
+		}
+		if ipNet.IP.To4() == nil {
+			return endpoint{net6: ipNet}, nil
+		}
+		return endpoint{
+			netID: binary.BigEndian.Uint32(ipNet.IP.To4()),
+			mask:  binary.BigEndian.Uint32(ipNet.Mask),
+		}, nil
+	}
+
+	if ip := net.ParseIP(input); ip != nil {
+		if ip.To4() == nil {
+			return endpoint{net6: &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}}, nil
+		}
+		return endpoint{netID: binary.BigEndian.Uint32(ip.To4()), mask: 0xFFFFFFFF}, nil
+	}
+
+	if _, err := strconv.ParseUint(input, 16, 64); err != nil || len(input) != 16 {
+		return endpoint{}, errors.New("invalid rule vmac: " + input)
+	}
+	return endpoint{vmac: input}, nil
+}
+
+func (e *endpoint) match(device *Device, ip uint32) bool {
+	if e.any {
+		return true
+	}
+	if e.vmac != "" {
+		return device != nil && device.VMac == e.vmac
+	}
+	if e.net6 != nil {
+		return false
+	}
+	return ip&e.mask == e.netID
+}
+
+func (e *endpoint) match6(device *Device, ip [16]byte) bool {
+	if e.any {
+		return true
+	}
+	if e.vmac != "" {
+		return device != nil && device.VMac == e.vmac
+	}
+	return e.net6 != nil && e.net6.Contains(ip[:])
+}
+
+func CheckRule(r *Rule) error {
+	if _, err := parseEndpoint(r.Src); err != nil {
+		return err
+	}
+	if _, err := parseEndpoint(r.Dst); err != nil {
+		return err
+	}
+	return nil
+}
+
+func loadRules(domain *Domain) {
+	var records []Rule
+	storage.Where(&Rule{Domain: domain.Name}).Find(&records)
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Priority == records[j].Priority {
+			return records[i].ID < records[j].ID
+		}
+		return records[i].Priority < records[j].Priority
+	})
+
+	domain.rules = nil
+	for _, record := range records {
+		src, err := parseEndpoint(record.Src)
+		if err != nil {
+			logger.Debug(err)
+			continue
+		}
+		dst, err := parseEndpoint(record.Dst)
+		if err != nil {
+			logger.Debug(err)
+			continue
+		}
+		domain.rules = append(domain.rules, rule{src: src, dst: dst, allow: record.Allow})
+	}
+}
+
+func ReloadRules(name string) {
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		loadRules(domain)
+	}
+}
+
+func isAllowed(domain *Domain, srcDev *Device, srcIP uint32, dstDev *Device, dstIP uint32) bool {
+	for idx := range domain.rules {
+		r := &domain.rules[idx]
+		if r.src.match(srcDev, srcIP) && r.dst.match(dstDev, dstIP) {
+			return r.allow
+		}
+	}
+	return true
+}
+
+func isAllowed6(domain *Domain, srcDev *Device, srcIP [16]byte, dstDev *Device, dstIP [16]byte) bool {
+	for idx := range domain.rules {
+		r := &domain.rules[idx]
+		if r.src.match6(srcDev, srcIP) && r.dst.match6(dstDev, dstIP) {
+			return r.allow
+		}
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package candy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/lanthora/cucurbita/storage"
+	"gorm.io/gorm"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		if err := storage.AutoMigrate(Session{}); err != nil {
+			return err
+		}
+
+		storage.Model(&Session{}).Where("reason = ?", "").Update("reason", STOPPED)
+
+		var id uint64
+		if err := storage.Model(&Session{}).Select("COALESCE(MAX(id), 0)").Scan(&id).Error; err != nil {
+			return err
+		}
+		lastSessionID.Store(id)
+		return nil
+	})
+}
+
+// Sessions are written behind, so their IDs are handed out here instead of
+// by storage, which lets the row that ends a session update the one that
+// started it.
+var lastSessionID atomic.Uint64
+
+// Sessions that started more than sessionRetention ago are deleted once they
+// ended.
+const sessionRetention = 90 * 24 * time.Hour
+
+// Reasons a session ended, besides the names of the rejection reasons.
+const (
+	CLOSED   = "closed"
+	TIMEOUT  = "timeout"
+	REPLACED = "replaced"
+	KICKED   = "kicked"
+	STUCK    = "stuck"
+	REPLAY   = "replay"
+	INVALID  = "invalid"
+	STOPPED  = "stopped"
+)
+
+// Session is one websocket connection of a device, from its VMAC message until
+// it was closed, so that connections that were turned away are recorded too.
+// RX and TX count the bytes of this connection while the device was online.
+// Sessions that were still open when the server stopped have no end.
+type Session struct {
+	ID         uint `gorm:"primaryKey"`
+	Domain     string
+	VMac       string
+	RemoteAddr string
+	IP         string
+	IP6        string
+	OS         string
+	Version    string
+	StartedAt  time.Time
+	EndedAt    time.Time
+	Reason     string
+	RX         uint64
+	TX         uint64
+
+	online  bool
+	startRX uint64
+	startTX uint64
+}
+
+// setReason records why the connection is about to end. The first reason
+// wins, so that the read error caused by closing the connection does not
+// replace the reason it was closed for.
+func (ws *Websocket) setReason(reason string) {
+	ws.reason.CompareAndSwap(nil, &reason)
+}
+
+// closeFor closes the connection for the given reason.
+func (ws *Websocket) closeFor(reason string) {
+	ws.setReason(reason)
+	ws.conn.Close()
+}
+
+// readErrorReason tells a client that went silent from one that closed the
+// connection.
+func readErrorReason(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return TIMEOUT
+	}
+	return CLOSED
+}
+
+// startSession opens the session of ws once the device it names is let in.
+func startSession(ws *Websocket, domain *Domain, vmac string) {
+	if ws.session != nil {
+		return
+	}
+	ws.session = &Session{
+		ID:         uint(lastSessionID.Add(1)),
+		Domain:     domain.Name,
+		VMac:       vmac,
+		RemoteAddr: ws.remote,
+		StartedAt:  time.Now(),
+	}
+	row := *ws.session
+	queueWrite(func(tx *gorm.DB) error { return tx.Create(&row).Error })
+}
+
+// sessionOnline starts counting the traffic of the session of ws when its
+// device comes online.
+func sessionOnline(ws *Websocket, device *Device) {
+	session := ws.session
+	if session == nil || session.online {
+		return
+	}
+	session.online = true
+	session.startRX = device.RX
+	session.startTX = device.TX
+}
+
+// endSession closes the session of ws with the final counters of its device,
+// which is nil when the connection never got one. The counters restart at zero
+// when a quota period begins, in which case the current value is all that is
+// known.
+func endSession(ws *Websocket, device *Device, now time.Time) {
+	session := ws.session
+	if session == nil {
+		return
+	}
+	delta := func(current, start uint64) uint64 {
+		if current < start {
+			return current
+		}
+		return current - start
+	}
+
+	if device != nil {
+		session.IP = device.IP
+		session.IP6 = device.IP6
+		session.OS = device.OS
+		session.Version = device.Version
+	}
+	if device != nil && session.online {
+		session.RX = delta(device.RX, session.startRX)
+		session.TX = delta(device.TX, session.startTX)
+	}
+	session.EndedAt = now
+	session.Reason = CLOSED
+	if reason := ws.reason.Load(); reason != nil {
+		session.Reason = *reason
+	}
+	row := *session
+	queueWrite(func(tx *gorm.DB) error { return tx.Save(&row).Error })
+}
+
+// runSessions deletes the sessions beyond retention every hour until ctx is
+// done.
+func runSessions(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			storage.Delete(&Session{}, "reason != ? AND started_at < ?", "", now.Add(-sessionRetention))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package candy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
+	"gorm.io/gorm"
+)
+
+func init() {
+	storage.OnOpen(func() error {
+		return storage.AutoMigrate(Storm{})
+	})
+}
+
+// Broadcast and multicast frames are copied to every device of a domain, so
+// each device may only send them at BroadcastRate bytes per second. A zero
+// BroadcastRate leaves them unlimited, which also turns off storm detection.
+
+// A device that has stormDrops broadcast frames dropped within stormWindow is
+// flooding the domain and may not broadcast at all for stormMute.
+const (
+	stormWindow = 10 * time.Second
+	stormDrops  = 100
+	stormMute   = time.Minute
+)
+
+// Storm records a device that was muted for flooding broadcasts.
+type Storm struct {
+	ID         uint `gorm:"primaryKey"`
+	Domain     string
+	VMac       string
+	StartedAt  time.Time
+	MutedUntil time.Time
+}
+
+type stormGuard struct {
+	limiter     bucket
+	mutex       sync.Mutex
+	windowStart time.Time
+	dropped     int
+	mutedUntil  time.Time
+}
+
+// allowBroadcast applies the broadcast limit of device to a frame that is about
+// to be copied to other devices and mutes the device when it keeps exceeding
+// the limit.
+func allowBroadcast(domain *Domain, device *Device, size int) bool {
+	g := &device.storm
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(g.mutedUntil) {
+		device.Dropped++
+		metrics.stormDropped.Add(1)
+		return false
+	}
+	if g.limiter.allow(size) {
+		return true
+	}
+
+	device.Dropped++
+	metrics.stormDropped.Add(1)
+
+	if now.Sub(g.windowStart) > stormWindow {
+		g.windowStart = now
+		g.dropped = 0
+	}
+	g.dropped++
+	if g.dropped < stormDrops {
+		return false
+	}
+
+	g.dropped = 0
+	g.mutedUntil = now.Add(stormMute)
+	metrics.storms.Add(1)
+	logger.Debugf("broadcast storm: domain=%v vmac=%v muted until %v", domain.Name, device.VMac, g.mutedUntil.Format(time.DateTime))
+
+	storm := Storm{Domain: domain.Name, VMac: device.VMac, StartedAt: now, MutedUntil: g.mutedUntil}
+	queueWrite(func(tx *gorm.DB) error { return tx.Create(&storm).Error })
+	return false
+}
@@ -0,0 +1,169 @@
+package candy
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+	"github.com/lanthora/cucurbita/storage"
+	"gorm.io/gorm"
+)
+
+// Used when neither the domain nor the global policy sets a minimum version.
+const defaultMinVersion = ">= 5.4"
+
+// defaultPolicy is the global version policy for domains that do not set
+// their own. It is kept in memory because it is checked on every ping.
+var defaultPolicy struct {
+	mutex   sync.RWMutex
+	min     string
+	blocked string
+}
+
+func init() {
+	storage.OnOpen(func() error {
+		min := &storage.Config{Key: "min_version"}
+		if result := storage.Where(min).Take(min); result.Error != nil {
+			min.Value = defaultMinVersion
+		}
+		blocked := &storage.Config{Key: "blocked_version"}
+		storage.Where(blocked).Take(blocked)
+
+		defaultPolicy.min = min.Value
+		defaultPolicy.blocked = blocked.Value
+		return nil
+	})
+}
+
+func parseConstraint(input string) (version.Constraints, error) {
+	if strings.TrimSpace(input) == "" {
+		return nil, nil
+	}
+	constraints, err := version.NewConstraint(input)
+	if err != nil {
+		return nil, errors.New("invalid version constraint: " + input)
+	}
+	return constraints, nil
+}
+
+func CheckVersionPolicy(min, blocked string) error {
+	if _, err := parseConstraint(min); err != nil {
+		return err
+	}
+	_, err := parseConstraint(blocked)
+	return err
+}
+
+func DefaultVersionPolicy() (min, blocked string) {
+	defaultPolicy.mutex.RLock()
+	defer defaultPolicy.mutex.RUnlock()
+	return defaultPolicy.min, defaultPolicy.blocked
+}
+
+func UpdateDefaultVersionPolicy(min, blocked string) error {
+	if err := CheckVersionPolicy(min, blocked); err != nil {
+		return err
+	}
+	if result := storage.Save(&storage.Config{Key: "min_version", Value: min}); result.Error != nil {
+		return result.Error
+	}
+	if result := storage.Save(&storage.Config{Key: "blocked_version", Value: blocked}); result.Error != nil {
+		return result.Error
+	}
+
+	defaultPolicy.mutex.Lock()
+	defer defaultPolicy.mutex.Unlock()
+	defaultPolicy.min = min
+	defaultPolicy.blocked = blocked
+	return nil
+}
+
+func UpdateVersionPolicy(name, min, blocked string) error {
+	if err := CheckVersionPolicy(min, blocked); err != nil {
+		return err
+	}
+	values := map[string]interface{}{"min_version": min, "blocked_version": blocked}
+	if result := storage.Model(&Domain{Name: name}).Updates(values); result.Error != nil {
+		return result.Error
+	}
+
+	nameDomainMapMutex.RLock()
+	defer nameDomainMapMutex.RUnlock()
+
+	if domain, ok := nameDomainMap[name]; ok {
+		domain.mutex.Lock()
+		defer domain.mutex.Unlock()
+		domain.MinVersion = min
+		domain.BlockedVersion = blocked
+	}
+	return nil
+}
+
+// checkVersion applies the version policy of the domain, falling back to the
+// global policy for each constraint the domain leaves empty.
+func checkVersion(domain *Domain, input string) error {
+	clientVersion, err := version.NewVersion(input)
+	if err != nil {
+		return err
+	}
+
+	min, blocked := DefaultVersionPolicy()
+	if domain.MinVersion != "" {
+		min = domain.MinVersion
+	}
+	if domain.BlockedVersion != "" {
+		blocked = domain.BlockedVersion
+	}
+
+	if constraints, err := parseConstraint(min); err != nil {
+		return err
+	} else if constraints != nil && !constraints.Check(clientVersion) {
+		return errors.New("client needs to be updated: " + input)
+	}
+	if constraints, err := parseConstraint(blocked); err != nil {
+		return err
+	} else if constraints != nil && constraints.Check(clientVersion) {
+		return errors.New("client version is blocked: " + input)
+	}
+	return nil
+}
+
+// clientInfoChanged reports whether a ping reports another client than the
+// one recorded, which is rare enough to take the domain lock for.
+func clientInfoChanged(device *Device, os, clientVersion string, outdated bool) bool {
+	return device.OS != os || device.Version != clientVersion || device.Outdated != outdated
+}
+
+// updateClientInfo records the reported client and whether the version policy
+// rejected it, so outdated machines can be found after the connection ends.
+// Rows are only created once a device authenticates. Before that, the columns
+// of a device that is already known are updated, because an outdated client
+// cannot authenticate.
+func updateClientInfo(domain *Domain, device *Device, os, clientVersion string, outdated bool) {
+	device.OS = os
+	device.Version = clientVersion
+	device.Outdated = outdated
+
+	if device.Online {
+		markDirty(device)
+		return
+	}
+
+	key := Device{Domain: domain.Name, VMac: device.VMac}
+	values := map[string]interface{}{"os": os, "version": clientVersion, "outdated": outdated}
+	queueWrite(func(tx *gorm.DB) error {
+		return tx.Model(&key).Updates(values).Error
+	})
+}
+
+// loadDevice reads the stored fields of a device that authenticates, keeping
+// the client it reported in the meantime.
+func loadDevice(device *Device) {
+	os, clientVersion, outdated := device.OS, device.Version, device.Outdated
+	storage.Find(device)
+	loadUnsavedCounters(device)
+	if clientVersion != "" {
+		device.OS, device.Version, device.Outdated = os, clientVersion, outdated
+	}
+}
@@ -1,29 +1,30 @@
 package candy
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"github.com/hashicorp/go-version"
 	"github.com/lanthora/cucurbita/logger"
 	"github.com/lanthora/cucurbita/storage"
-	"github.com/lunixbochs/struc"
+	"gorm.io/gorm"
 )
 
 func init() {
-	err := storage.AutoMigrate(Device{})
-	if err != nil {
-		logger.Fatal(err)
-	}
-
-	storage.Model(&Device{}).Where("online = true").Update("online", false)
+	storage.OnOpen(func() error {
+		if err := storage.AutoMigrate(Device{}); err != nil {
+			return err
+		}
+		return storage.Model(&Device{}).Where("online = true").Update("online", false).Error
+	})
 }
 
 func WebsocketMiddleware() gin.HandlerFunc {
@@ -37,6 +38,34 @@ func WebsocketMiddleware() gin.HandlerFunc {
 	}
 }
 
+// connections counts the websockets being handled, which the HTTP server does
+// not wait for once they are hijacked.
+var connections sync.WaitGroup
+
+// CloseConnections closes every connection for STOPPED and waits until their
+// devices went offline, so that the final Sync saves them and their sessions.
+func CloseConnections(ctx context.Context) {
+	nameDomainMapMutex.RLock()
+	for _, domain := range nameDomainMap {
+		domain.mutex.RLock()
+		for ws := range domain.wsDeviceMap {
+			ws.closeFor(STOPPED)
+		}
+		domain.mutex.RUnlock()
+	}
+	nameDomainMapMutex.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
 func handleWebsocket(c *gin.Context) {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
@@ -47,25 +76,36 @@ func handleWebsocket(c *gin.Context) {
 	}
 	defer conn.Close()
 
+	connections.Add(1)
+	defer connections.Done()
+
 	domain := GetDomain(strings.TrimPrefix(c.Request.URL.Path, "/"))
 	if domain == nil {
 		return
 	}
-	ws := &Websocket{conn: conn}
+	ws := newWebsocket(conn)
+	ws.remote = c.ClientIP()
+	defer ws.close()
+
+	metrics.connects.Add(1)
+	defer metrics.disconnects.Add(1)
+
 	conn.SetPingHandler(func(buffer string) error { return handlePingMessage(ws, domain, buffer) })
 
 	for {
 		ws.UpdateReadDeadline()
 		messageType, buffer, err := conn.ReadMessage()
 		if err != nil {
+			ws.setReason(readErrorReason(err))
 			break
 		}
 		if messageType != websocket.BinaryMessage {
 			continue
 		}
-		if ws.banned {
+		if len(buffer) == 0 {
 			continue
 		}
+		countReceived(buffer)
 
 		switch uint8(buffer[0]) {
 		case AUTH:
@@ -80,12 +120,28 @@ func handleWebsocket(c *gin.Context) {
 			err = handleVMacMessage(ws, domain, buffer)
 		case DISCOVERY:
 			err = handleDiscoveryMessage(ws, domain, buffer)
+		case AUTH6:
+			err = handleAuth6Message(ws, domain, buffer)
+		case DHCP6:
+			err = handleDHCP6Message(ws, domain, buffer)
 		case GENERAL:
 			err = handleGeneralMessage(ws, domain, buffer)
 		}
 
+		if errors.Is(err, errReplay) {
+			metrics.replays.Add(1)
+			logger.Debugf("%v: remote=%v", err, c.ClientIP())
+			ws.setReason(REPLAY)
+			break
+		}
 		if err != nil {
 			logger.Debug(err)
+			var r *rejection
+			if errors.As(err, &r) {
+				countRejection(r.reason)
+				ws.Reject(r.reason, r.Error())
+			}
+			ws.setReason(INVALID)
 			break
 		}
 	}
@@ -93,18 +149,42 @@ func handleWebsocket(c *gin.Context) {
 	domain.mutex.Lock()
 	defer domain.mutex.Unlock()
 
+	endSession(ws, domain.wsDeviceMap[ws], time.Now())
+
 	if device, ok := domain.wsDeviceMap[ws]; ok {
+		device.QueueDropped += ws.dropped.Swap(0)
+
 		if domain.ipWsMap[device.ip] == ws {
 			delete(domain.ipWsMap, device.ip)
 		}
+		if domain.ip6WsMap[device.ip6] == ws {
+			delete(domain.ip6WsMap, device.ip6)
+		}
+		if domain.vmacWsMap[device.VMac] == ws {
+			delete(domain.vmacWsMap, device.VMac)
+		}
 
 		if device.Online {
 			device.Online = false
 			device.ConnUpdatedAt = time.Now()
-			storage.Save(device)
+			markDirty(device)
+			samples := []Traffic{sampleDevice(domain, device, device.ConnUpdatedAt)}
+			queueWrite(func(tx *gorm.DB) error { return addTraffic(tx, samples) })
+
+			if domain.DHCP != "" && device.ip != 0 {
+				updateLease(domain, device.VMac, device.ip)
+			}
 		}
 
 		delete(domain.wsDeviceMap, ws)
+		domain.groups.remove(ws)
+
+		if hasRoutes(domain, device.VMac) || isExitNode(domain, device) {
+			broadcastRoutes(domain)
+		}
+		if isExitNode(domain, device) {
+			logExitNode(domain)
+		}
 	}
 }
 
@@ -116,32 +196,29 @@ func handlePingMessage(ws *Websocket, domain *Domain, buffer string) error {
 		if len(info) < 3 || info[0] != "candy" {
 			return errors.New("invalid ping message format: " + buffer)
 		}
-		clientVersion, err := version.NewVersion(info[2])
-		if err != nil {
-			return err
-		}
-		constraints, err := version.NewConstraint(">= 5.4")
-		if err != nil {
-			return err
-		}
-		if !constraints.Check(clientVersion) {
-			return errors.New("client needs to be updated")
-		}
 
 		domain.mutex.RLock()
-		defer domain.mutex.RUnlock()
-		if device, ok := domain.wsDeviceMap[ws]; ok {
-			if device.OS != info[1] || device.Version != info[2] {
-				device.OS = info[1]
-				device.Version = info[2]
+		err := checkVersion(domain, info[2])
+		device, ok := domain.wsDeviceMap[ws]
+		changed := ok && clientInfoChanged(device, info[1], info[2], err != nil)
+		domain.mutex.RUnlock()
+
+		if changed {
+			domain.mutex.Lock()
+			if device, ok := domain.wsDeviceMap[ws]; ok {
+				updateClientInfo(domain, device, info[1], info[2], err != nil)
 			}
+			domain.mutex.Unlock()
 		}
-		return nil
+		return err
 	}()
 
-	if err != nil && !ws.banned {
-		ws.banned = true
-		logger.Debug("client is banned: ", err)
+	// returning the error ends the read loop
+	if err != nil {
+		logger.Debug("client is outdated: ", err)
+		countRejection(OUTDATED)
+		ws.Reject(OUTDATED, err.Error())
+		return err
 	}
 
 	ws.WritePong([]byte(buffer))
@@ -149,16 +226,19 @@ func handlePingMessage(ws *Websocket, domain *Domain, buffer string) error {
 }
 
 func handleAuthMessage(ws *Websocket, domain *Domain, buffer []byte) error {
-	r := bytes.NewReader(buffer)
 	message := &AuthMessage{}
-	if err := struc.Unpack(r, message); err != nil {
+	if err := message.UnmarshalBinary(buffer); err != nil {
 		return err
 	}
 
-	if err := checkAuthMessage(domain, message); err != nil {
+	if err := checkAuthMessage(domain, ws, message); err != nil {
 		return err
 	}
 
+	rollPeriod(domain)
+	domain.period.RLock()
+	defer domain.period.RUnlock()
+
 	domain.mutex.Lock()
 	defer domain.mutex.Unlock()
 
@@ -167,10 +247,18 @@ func handleAuthMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 		return errors.New("invalid auth message: vmac message needs to be received first")
 	}
 
+	if device.Status == PENDING {
+		return nil
+	}
+
 	if domain.netID != domain.mask&message.IP {
 		return errors.New("auth address does not match network configuration")
 	}
 
+	if isReservedByOther(domain, device.VMac, message.IP) {
+		return errors.New("auth address is reserved for another device")
+	}
+
 	for oldWs, oldDevice := range domain.wsDeviceMap {
 		if oldWs == ws {
 			continue
@@ -180,22 +268,111 @@ func handleAuthMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 			device.RX = oldDevice.RX
 			device.TX = oldDevice.TX
 			oldDevice.Online = false
-			oldWs.conn.Close()
+			oldWs.closeFor(REPLACED)
 		}
 	}
 
 	device.ip = message.IP
 	domain.ipWsMap[message.IP] = ws
 
-	storage.Find(device)
+	if domain.DHCP != "" {
+		updateLease(domain, device.VMac, message.IP)
+	}
+
+	loadDevice(device)
+	markSampled(device)
+	if err := checkQuotaOnAuth(domain, device); err != nil {
+		return err
+	}
 	device.IP = uint32ToIpString(message.IP)
 	device.Online = true
+	domain.vmacWsMap[device.VMac] = ws
+	device.ConnUpdatedAt = time.Now()
+	markDirty(device)
+	sessionOnline(ws, device)
+
+	if hasRoutes(domain, device.VMac) || isExitNode(domain, device) {
+		broadcastRoutes(domain)
+	} else if hasRouteTable(domain) {
+		pushRoutes(domain, ws, device)
+	}
+	if isExitNode(domain, device) {
+		logExitNode(domain)
+	}
+	return nil
+}
+
+func handleAuth6Message(ws *Websocket, domain *Domain, buffer []byte) error {
+	message := &Auth6Message{}
+	if err := message.UnmarshalBinary(buffer); err != nil {
+		return err
+	}
+
+	if err := checkAuth6Message(domain, ws, message); err != nil {
+		return err
+	}
+
+	rollPeriod(domain)
+	domain.period.RLock()
+	defer domain.period.RUnlock()
+
+	domain.mutex.Lock()
+	defer domain.mutex.Unlock()
+
+	device, ok := domain.wsDeviceMap[ws]
+	if !ok {
+		return errors.New("invalid auth6 message: vmac message needs to be received first")
+	}
+
+	if device.Status == PENDING {
+		return nil
+	}
+
+	if domain.prefix6 == nil || !domain.prefix6.Contains(message.IP[:]) {
+		return errors.New("auth6 address does not match network configuration")
+	}
+
+	for oldWs, oldDevice := range domain.wsDeviceMap {
+		if oldWs == ws {
+			continue
+		}
+
+		if oldDevice.VMac == device.VMac || oldDevice.ip6 == message.IP {
+			device.RX = oldDevice.RX
+			device.TX = oldDevice.TX
+			oldDevice.Online = false
+			oldWs.closeFor(REPLACED)
+		}
+	}
+
+	device.ip6 = message.IP
+	domain.ip6WsMap[message.IP] = ws
+
+	if !device.Online {
+		loadDevice(device)
+		markSampled(device)
+		if err := checkQuotaOnAuth(domain, device); err != nil {
+			return err
+		}
+	}
+	device.IP6 = net.IP(message.IP[:]).String()
+	device.Online = true
+	domain.vmacWsMap[device.VMac] = ws
 	device.ConnUpdatedAt = time.Now()
-	storage.Save(device)
+	markDirty(device)
+	sessionOnline(ws, device)
 	return nil
 }
 
 func handleForwardMessage(ws *Websocket, domain *Domain, buffer []byte) error {
+	// frames for a bridged network are handed over once the lock is released
+	var bridged func()
+	defer func() {
+		if bridged != nil {
+			bridged()
+		}
+	}()
+
 	domain.mutex.RLock()
 	defer domain.mutex.RUnlock()
 
@@ -208,21 +385,51 @@ func handleForwardMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 		return nil
 	}
 
-	r := bytes.NewReader(buffer)
+	if !allowTraffic(domain, device, len(buffer)) {
+		return nil
+	}
+
+	if len(buffer) > 1 && buffer[1]>>4 == 6 {
+		return forward6(ws, domain, device, buffer)
+	}
+
 	message := &ForwardMessage{}
-	if err := struc.Unpack(r, message); err != nil {
+	if err := message.UnmarshalBinary(buffer); err != nil {
 		return err
 	}
 
-	if device.ip != message.Src {
+	if device.ip != message.Src && !isRoutedBy(domain, device, message.Src) && !(isExitNode(domain, device) && isOutside(domain, message.Src)) {
 		return errors.New("forward message that does not match login information")
 	}
 
 	device.TX += uint64(len(buffer))
+	snoopIGMP(domain, ws, buffer)
 
 	if dstWs, ok := domain.ipWsMap[message.Dst]; ok {
-		dstWs.WriteMessage(buffer)
-		domain.wsDeviceMap[dstWs].RX += uint64(len(buffer))
+		dstDev := domain.wsDeviceMap[dstWs]
+		if isAllowed(domain, device, message.Src, dstDev, message.Dst) {
+			if dstWs.WriteMessage(buffer) == nil {
+				dstDev.RX += uint64(len(buffer))
+				observe(domain, device, dstDev, buffer)
+			}
+		}
+	} else if dstWs, dstDev := lookupRoute(domain, message.Dst); dstWs != nil && dstWs != ws {
+		if isAllowed(domain, device, message.Src, dstDev, message.Dst) {
+			if dstWs.WriteMessage(buffer) == nil {
+				dstDev.RX += uint64(len(buffer))
+				observe(domain, device, dstDev, buffer)
+			}
+		}
+	} else if b := lookupBridge(domain, message.Dst); b != nil {
+		peer, src, dst := *b, message.Src, message.Dst
+		bridged = func() { forwardBridge(domain, device, peer, buffer, src, dst) }
+	} else if dstWs, dstDev := exitNode(domain); dstWs != nil && dstWs != ws && isOutside(domain, message.Dst) {
+		if isAllowed(domain, device, message.Src, dstDev, message.Dst) {
+			if dstWs.WriteMessage(buffer) == nil {
+				dstDev.RX += uint64(len(buffer))
+				observe(domain, device, dstDev, buffer)
+			}
+		}
 	}
 
 	broadcast := func() bool {
@@ -232,32 +439,129 @@ func handleForwardMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 		if domain.netID|^domain.mask == message.Dst {
 			return true
 		}
-		if message.Dst&0xF0000000 == 0xE0000000 {
-			return true
+		if isMulticast(message.Dst) {
+			return isFlooded(domain, message.Dst)
 		}
 		return false
 	}()
 
+	multicast := domain.Broadcast && isMulticast(message.Dst) && !broadcast
+
+	if (broadcast || multicast) && !allowBroadcast(domain, device, len(buffer)) {
+		return nil
+	}
+
+	if multicast {
+		forwardMulticast(ws, domain, device, buffer, message.Src, message.Dst)
+	}
+
 	if broadcast {
+		metrics.broadcasts.Add(1)
+		var seen fanout
 		for dstWs, dstDev := range domain.wsDeviceMap {
-			if dstWs != ws && dstDev.Online {
-				dstWs.WriteMessage(buffer)
+			if dstWs != ws && dstDev.Online && isAllowed(domain, device, message.Src, dstDev, dstDev.ip) {
+				if dstWs.WriteMessage(buffer) == nil {
+					dstDev.RX += uint64(len(buffer))
+					metrics.broadcastDeliveries.Add(1)
+					seen.add(domain, dstDev)
+				}
+			}
+		}
+		seen.observe(domain, device, buffer)
+	}
+
+	return nil
+}
+
+func forward6(ws *Websocket, domain *Domain, device *Device, buffer []byte) error {
+	message := &Forward6Message{}
+	if err := message.UnmarshalBinary(buffer); err != nil {
+		return err
+	}
+
+	if device.ip6 != message.Src {
+		return errors.New("forward6 message that does not match login information")
+	}
+
+	device.TX += uint64(len(buffer))
+
+	if dstWs, ok := domain.ip6WsMap[message.Dst]; ok {
+		dstDev := domain.wsDeviceMap[dstWs]
+		if isAllowed6(domain, device, message.Src, dstDev, message.Dst) {
+			if dstWs.WriteMessage(buffer) == nil {
 				dstDev.RX += uint64(len(buffer))
+				observe(domain, device, dstDev, buffer)
+			}
+		}
+	}
+
+	if domain.Broadcast && message.Dst[0] == 0xFF && allowBroadcast(domain, device, len(buffer)) {
+		metrics.broadcasts.Add(1)
+		var seen fanout
+		for dstWs, dstDev := range domain.wsDeviceMap {
+			if dstWs != ws && dstDev.Online && dstDev.ip6 != [16]byte{} && isAllowed6(domain, device, message.Src, dstDev, dstDev.ip6) {
+				if dstWs.WriteMessage(buffer) == nil {
+					dstDev.RX += uint64(len(buffer))
+					metrics.broadcastDeliveries.Add(1)
+					seen.add(domain, dstDev)
+				}
 			}
 		}
+		seen.observe(domain, device, buffer)
 	}
 
 	return nil
 }
 
+// observe hands a FORWARD frame that src delivered to dst to the capture and
+// the monitor of the domain. It runs only after the frame was queued, so that
+// dropped frames are left out.
+func observe(domain *Domain, src, dst *Device, buffer []byte) {
+	if domain.capture != nil {
+		domain.capture.record(src, dst, buffer)
+	}
+	if domain.Monitor != "" {
+		mirrorFrame(domain, src, dst, buffer)
+	}
+}
+
+// fanout collects the devices a broadcast or multicast frame reached, so that
+// the frame is observed once instead of once per copy.
+type fanout struct {
+	delivered bool
+	captured  *Device
+	mirrored  *Device
+}
+
+func (f *fanout) add(domain *Domain, dst *Device) {
+	f.delivered = true
+	if domain.capture != nil && dst.VMac == domain.capture.vmac {
+		f.captured = dst
+	}
+	if domain.mirrored[dst.VMac] && dst.VMac != domain.Monitor {
+		f.mirrored = dst
+	}
+}
+
+func (f *fanout) observe(domain *Domain, src *Device, buffer []byte) {
+	if !f.delivered {
+		return
+	}
+	if domain.capture != nil {
+		domain.capture.record(src, f.captured, buffer)
+	}
+	if domain.Monitor != "" {
+		mirrorFrame(domain, src, f.mirrored, buffer)
+	}
+}
+
 func handleDHCPMessage(ws *Websocket, domain *Domain, buffer []byte) error {
-	r := bytes.NewReader(buffer)
 	message := &DHCPMessage{}
-	if err := struc.Unpack(r, message); err != nil {
+	if err := message.UnmarshalBinary(buffer); err != nil {
 		return err
 	}
 
-	if err := checkDHCPMessage(domain, message); err != nil {
+	if err := checkDHCPMessage(domain, ws, message); err != nil {
 		return err
 	}
 
@@ -265,9 +569,55 @@ func handleDHCPMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 		return errors.New("current domain does not support dynamic addresses")
 	}
 
-	cidr := func(input []byte) string {
-		return string(input[:bytes.IndexByte(input[:], 0)])
-	}(message.Cidr)
+	cidr := nulTerminated(message.Cidr)
+
+	domain.mutex.Lock()
+	defer domain.mutex.Unlock()
+
+	device, ok := domain.wsDeviceMap[ws]
+	if !ok {
+		return errors.New("client must send vmac message first")
+	}
+
+	if device.Status == PENDING {
+		return nil
+	}
+
+	addr, ok := reservedAddress(domain, device.VMac)
+	if !ok {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err == nil && ip.To4() != nil && binary.BigEndian.Uint32(ipNet.Mask) == domain.mask && isAddressAvailable(domain, device.VMac, binary.BigEndian.Uint32(ip.To4())) {
+			addr = binary.BigEndian.Uint32(ip.To4())
+		} else if addr, err = allocateAddress(domain, device.VMac); err != nil {
+			return err
+		}
+	}
+
+	updateLease(domain, device.VMac, addr)
+	message.Cidr = []byte(uint32ToCidrString(addr, domain.mask))
+
+	if output, err := message.MarshalBinary(); err == nil {
+		ws.WriteMessage(output)
+		metrics.dhcp.Add(1)
+	}
+	return nil
+}
+
+func handleDHCP6Message(ws *Websocket, domain *Domain, buffer []byte) error {
+	message := &DHCP6Message{}
+	if err := message.UnmarshalBinary(buffer); err != nil {
+		return err
+	}
+
+	if err := checkDHCP6Message(domain, ws, message); err != nil {
+		return err
+	}
+
+	if domain.prefix6 == nil {
+		return errors.New("current domain does not support dynamic ipv6 addresses")
+	}
+
+	cidr := nulTerminated(message.Cidr)
 
 	domain.mutex.RLock()
 	defer domain.mutex.RUnlock()
@@ -276,56 +626,26 @@ func handleDHCPMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 	if !ok {
 		return errors.New("client must send vmac message first")
 	}
-	ip, ipNet, err := net.ParseCIDR(cidr)
-	needGenNewAddr := func() bool {
-		if err != nil {
-			return true
-		}
-		if binary.BigEndian.Uint32(ipNet.IP) != domain.netID {
-			return true
-		}
-		if binary.BigEndian.Uint32(ipNet.Mask) != domain.mask {
-			return true
-		}
-		devices := []Device{}
-		storage.Where(&Device{Domain: domain.Name, IP: ip.String()}).Find(&devices)
-		if len(devices) > 1 {
-			return true
-		}
-		if len(devices) == 0 {
-			return false
-		}
-		if len(devices) == 1 && devices[0].VMac == device.VMac {
-			return false
-		}
-		return true
-	}()
 
-	var oldHostID = domain.hostID
-	for needGenNewAddr {
-		updateHostID(domain)
-		result := storage.Where(&Device{Domain: domain.Name, IP: uint32ToIpString(domain.netID | domain.hostID)})
-		if result.RowsAffected == 0 {
-			break
-		}
-		if oldHostID == domain.hostID {
-			return errors.New("not enough addresses")
-		}
+	if device.Status == PENDING {
+		return nil
 	}
 
-	if needGenNewAddr {
-		ipNet := net.IPNet{
-			IP:   make(net.IP, 4),
-			Mask: make(net.IPMask, 4),
-		}
-		binary.BigEndian.PutUint32(ipNet.IP, domain.netID|domain.hostID)
-		binary.BigEndian.PutUint32(ipNet.Mask, domain.mask)
-		message.Cidr = []byte(ipNet.String())
+	var addr [16]byte
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err == nil && ip.To4() == nil && ipNet.Mask.String() == domain.prefix6.Mask.String() && isAddress6Available(domain, device.VMac, [16]byte(ip.To16())) {
+		addr = [16]byte(ip.To16())
+	} else if addr, err = allocateAddress6(domain, device.VMac); err != nil {
+		return err
 	}
 
-	var output bytes.Buffer
-	struc.Pack(&output, message)
-	ws.WriteMessage(output.Bytes())
+	ones, _ := domain.prefix6.Mask.Size()
+	message.Cidr = []byte(fmt.Sprintf("%v/%v", net.IP(addr[:]), ones))
+
+	if output, err := message.MarshalBinary(); err == nil {
+		ws.WriteMessage(output)
+		metrics.dhcp6.Add(1)
+	}
 	return nil
 }
 
@@ -338,9 +658,8 @@ func handlePeerConnMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 		return errors.New("peer conn unauthorized client")
 	}
 
-	r := bytes.NewReader(buffer)
 	message := &PeerConnMessage{}
-	if err := struc.Unpack(r, message); err != nil {
+	if err := message.UnmarshalBinary(buffer); err != nil {
 		return err
 	}
 
@@ -350,7 +669,7 @@ func handlePeerConnMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 
 	UpdateLocation(device, uint32ToIpString(message.IP))
 
-	if dst, ok := domain.ipWsMap[message.Dst]; ok {
+	if dst, ok := domain.ipWsMap[message.Dst]; ok && isAllowed(domain, device, message.Src, domain.wsDeviceMap[dst], message.Dst) {
 		dst.WriteMessage(buffer)
 	}
 
@@ -358,20 +677,39 @@ func handlePeerConnMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 }
 
 func handleVMacMessage(ws *Websocket, domain *Domain, buffer []byte) error {
-	r := bytes.NewReader(buffer)
 	message := &VMacMessage{}
-	if err := struc.Unpack(r, message); err != nil {
+	if err := message.UnmarshalBinary(buffer); err != nil {
+		return err
+	}
+
+	domain.mutex.RLock()
+	secret, err := deviceSecret(domain, message.VMac)
+	if err == nil {
+		err = checkVMacMessage(domain, ws, secret, message)
+	}
+	approval, broadcastRate := domain.Approval, domain.BroadcastRate
+	domain.mutex.RUnlock()
+	if err != nil {
 		return err
 	}
 
-	if err := checkVMacMessage(domain, message); err != nil {
+	if err := checkBan(domain, message.VMac); err != nil {
 		return err
 	}
 
+	device := &Device{Domain: domain.Name, VMac: message.VMac}
+	device.storm.limiter.setRate(broadcastRate)
+	if err := checkApproval(device, approval); err != nil {
+		return err
+	}
+	startSession(ws, domain, message.VMac)
+
 	domain.mutex.Lock()
 	defer domain.mutex.Unlock()
 
-	domain.wsDeviceMap[ws] = &Device{Domain: domain.Name, VMac: message.VMac}
+	ws.secret = secret
+	ws.vmac = message.VMac
+	domain.wsDeviceMap[ws] = device
 	return nil
 }
 
@@ -384,9 +722,8 @@ func handleDiscoveryMessage(ws *Websocket, domain *Domain, buffer []byte) error
 		return nil
 	}
 
-	r := bytes.NewReader(buffer)
 	message := &DiscoveryMessage{}
-	if err := struc.Unpack(r, message); err != nil {
+	if err := message.UnmarshalBinary(buffer); err != nil {
 		return err
 	}
 
@@ -397,17 +734,21 @@ func handleDiscoveryMessage(ws *Websocket, domain *Domain, buffer []byte) error
 	device.TX += uint64(len(buffer))
 
 	if dstWs, ok := domain.ipWsMap[message.Dst]; ok {
-		dstWs.WriteMessage(buffer)
-		if dstDev, ok := domain.wsDeviceMap[dstWs]; ok {
-			dstDev.RX += uint64(len(buffer))
+		if dstDev, ok := domain.wsDeviceMap[dstWs]; ok && isAllowed(domain, device, message.Src, dstDev, message.Dst) {
+			if dstWs.WriteMessage(buffer) == nil {
+				dstDev.RX += uint64(len(buffer))
+			}
 		}
 	}
 
-	if uint32(0xFFFFFFFF) == message.Dst {
+	if uint32(0xFFFFFFFF) == message.Dst && allowBroadcast(domain, device, len(buffer)) {
+		metrics.broadcasts.Add(1)
 		for dstWs, dstDev := range domain.wsDeviceMap {
-			if dstWs != ws && dstDev.Online {
-				dstWs.WriteMessage(buffer)
-				dstDev.RX += uint64(len(buffer))
+			if dstWs != ws && dstDev.Online && isAllowed(domain, device, message.Src, dstDev, dstDev.ip) {
+				if dstWs.WriteMessage(buffer) == nil {
+					dstDev.RX += uint64(len(buffer))
+					metrics.broadcastDeliveries.Add(1)
+				}
 			}
 		}
 	}
@@ -424,9 +765,8 @@ func handleGeneralMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 		return nil
 	}
 
-	r := bytes.NewReader(buffer)
 	message := &GeneralMessage{}
-	if err := struc.Unpack(r, message); err != nil {
+	if err := message.UnmarshalBinary(buffer); err != nil {
 		return err
 	}
 
@@ -434,20 +774,28 @@ func handleGeneralMessage(ws *Websocket, domain *Domain, buffer []byte) error {
 		return errors.New("general message that does not match login information")
 	}
 
+	if message.Subtype == ADVERTISE && message.Dst == 0 {
+		return handleAdvertiseMessage(domain, device, buffer)
+	}
+
 	device.TX += uint64(len(buffer))
 
 	if dstWs, ok := domain.ipWsMap[message.Dst]; ok {
-		dstWs.WriteMessage(buffer)
-		if dstDev, ok := domain.wsDeviceMap[dstWs]; ok {
-			dstDev.RX += uint64(len(buffer))
+		if dstDev, ok := domain.wsDeviceMap[dstWs]; ok && isAllowed(domain, device, message.Src, dstDev, message.Dst) {
+			if dstWs.WriteMessage(buffer) == nil {
+				dstDev.RX += uint64(len(buffer))
+			}
 		}
 	}
 
-	if domain.Broadcast && uint32(0xFFFFFFFF) == message.Dst {
+	if domain.Broadcast && uint32(0xFFFFFFFF) == message.Dst && allowBroadcast(domain, device, len(buffer)) {
+		metrics.broadcasts.Add(1)
 		for dstWs, dstDev := range domain.wsDeviceMap {
-			if dstWs != ws && dstDev.Online {
-				dstWs.WriteMessage(buffer)
-				dstDev.RX += uint64(len(buffer))
+			if dstWs != ws && dstDev.Online && isAllowed(domain, device, message.Src, dstDev, dstDev.ip) {
+				if dstWs.WriteMessage(buffer) == nil {
+					dstDev.RX += uint64(len(buffer))
+					metrics.broadcastDeliveries.Add(1)
+				}
 			}
 		}
 	}
@@ -460,3 +808,13 @@ func uint32ToIpString(ip uint32) string {
 	binary.BigEndian.PutUint32(buffer, ip)
 	return net.IP(buffer).String()
 }
+
+func uint32ToCidrString(ip, mask uint32) string {
+	ipNet := net.IPNet{
+		IP:   make(net.IP, 4),
+		Mask: make(net.IPMask, 4),
+	}
+	binary.BigEndian.PutUint32(ipNet.IP, ip)
+	binary.BigEndian.PutUint32(ipNet.Mask, mask)
+	return ipNet.String()
+}
@@ -0,0 +1,37 @@
+package candy
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func BenchmarkHandleForwardMessage(b *testing.B) {
+	domain := newTestDomain(b, "10.0.0.0/24", SEQUENTIAL)
+	src, dst := mustIP(b, "10.0.0.1"), mustIP(b, "10.0.0.2")
+	connect(domain, "000000000000000a", src)
+	connect(domain, "000000000000000b", dst)
+
+	receiver := domain.ipWsMap[dst]
+	receiver.queue = make(chan []byte, 1024)
+	defer close(receiver.queue)
+	go func() {
+		for range receiver.queue {
+		}
+	}()
+
+	buffer := make([]byte, forwardMessageSize+1400)
+	buffer[0] = FORWARD
+	buffer[1] = 0x45
+	binary.BigEndian.PutUint32(buffer[13:], src)
+	binary.BigEndian.PutUint32(buffer[17:], dst)
+
+	sender := domain.ipWsMap[src]
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buffer)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := handleForwardMessage(sender, domain, buffer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
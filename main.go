@@ -1,8 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/lanthora/cucurbita/candy"
+	"github.com/lanthora/cucurbita/logger"
+	"github.com/lanthora/cucurbita/storage"
 	"github.com/lanthora/cucurbita/web"
 )
 
@@ -11,6 +21,10 @@ func init() {
 }
 
 func main() {
+	if err := storage.Open(""); err != nil {
+		logger.Fatal(err)
+	}
+
 	r := gin.New()
 	r.HTMLRender = web.HTMLRender
 	r.Use(candy.WebsocketMiddleware(), web.LoginMiddleware())
@@ -24,10 +38,97 @@ func main() {
 	r.GET("/domain", web.DomainPage)
 	r.GET("/domain/insert", web.InsertDomainPage)
 	r.POST("/domain/insert", web.InsertDomain)
+	r.GET("/domain/exit", web.ExitNodePage)
+	r.POST("/domain/exit", web.UpdateExitNode)
+	r.GET("/domain/skew", web.SkewPage)
+	r.POST("/domain/skew", web.UpdateSkew)
+	r.GET("/domain/rate", web.DomainRatePage)
+	r.POST("/domain/rate", web.UpdateDomainRate)
+	r.GET("/domain/quota", web.DomainQuotaPage)
+	r.POST("/domain/quota", web.UpdateDomainQuota)
+	r.GET("/domain/version", web.VersionPage)
+	r.POST("/domain/version", web.UpdateVersion)
+	r.GET("/domain/multicast", web.MulticastPage)
+	r.POST("/domain/multicast", web.UpdateMulticast)
+	r.GET("/domain/mirror", web.MirrorPage)
+	r.POST("/domain/mirror", web.UpdateMirror)
+	r.GET("/domain/approval", web.UpdateApproval)
 	r.GET("/domain/delete", web.DeleteDomain)
 
+	r.GET("/rule", web.RulePage)
+	r.GET("/rule/insert", web.InsertRulePage)
+	r.POST("/rule/insert", web.InsertRule)
+	r.GET("/rule/delete", web.DeleteRule)
+
+	r.GET("/credential", web.CredentialPage)
+	r.GET("/credential/insert", web.InsertCredentialPage)
+	r.POST("/credential/insert", web.InsertCredential)
+	r.GET("/credential/delete", web.DeleteCredential)
+	r.GET("/credential/remove", web.RemoveCredential)
+	r.GET("/credential/keyonly", web.UpdateKeyOnly)
+
+	r.GET("/reservation", web.ReservationPage)
+	r.GET("/reservation/insert", web.InsertReservationPage)
+	r.POST("/reservation/insert", web.InsertReservation)
+	r.GET("/reservation/delete", web.DeleteReservation)
+
+	r.GET("/route", web.RoutePage)
+	r.GET("/route/approve", web.ApproveRoute)
+	r.GET("/route/delete", web.DeleteRoute)
+
+	r.GET("/bridge", web.BridgePage)
+	r.GET("/bridge/insert", web.InsertBridgePage)
+	r.POST("/bridge/insert", web.InsertBridge)
+	r.GET("/bridge/delete", web.DeleteBridge)
+
 	r.GET("/device", web.DevicePage)
+	r.GET("/device/rate", web.DeviceRatePage)
+	r.POST("/device/rate", web.UpdateDeviceRate)
+	r.GET("/device/quota", web.DeviceQuotaPage)
+	r.POST("/device/quota", web.UpdateDeviceQuota)
+	r.GET("/device/approve", web.ApproveDevice)
+	r.GET("/device/deny", web.DenyDevice)
+	r.GET("/device/disconnect", web.DisconnectDevice)
 	r.GET("/device/delete", web.DeleteDevice)
 
-	r.Run(":80")
+	r.GET("/ban", web.BanPage)
+	r.GET("/ban/insert", web.InsertBanPage)
+	r.POST("/ban/insert", web.InsertBan)
+	r.GET("/ban/delete", web.DeleteBan)
+
+	r.GET("/usage", web.UsagePage)
+	r.GET("/device/detail", web.DeviceDetailPage)
+	r.GET("/storm", web.StormPage)
+	r.GET("/capture", web.CapturePage)
+	r.POST("/capture", web.StartCapture)
+	r.GET("/capture/stop", web.StopCapture)
+	r.GET("/capture/delete", web.DeleteCapture)
+	r.GET("/capture/download", web.DownloadCapture)
+	r.GET("/traffic", web.TrafficPage)
+
+	r.GET("/metrics", web.Metrics)
+	r.GET("/metrics/token", web.MetricsTokenPage)
+	r.GET("/metrics/token/reset", web.ResetMetricsToken)
+	r.GET("/metrics/token/disable", web.DisableMetrics)
+
+	server := &http.Server{Addr: ":80", Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := candy.Start(ctx)
+	<-ctx.Done()
+
+	// websockets are hijacked and not waited for by the server, they are
+	// closed separately so that the final sync saves them offline
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+	<-stopped
+	candy.CloseConnections(shutdownCtx)
+	candy.Sync()
 }
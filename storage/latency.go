@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Latency is the time spent in one kind of database operation since start.
+type Latency struct {
+	Count   uint64
+	Seconds float64
+}
+
+var latencies = struct {
+	mutex sync.Mutex
+	m     map[string]Latency
+}{m: make(map[string]Latency)}
+
+func Latencies() map[string]Latency {
+	latencies.mutex.Lock()
+	defer latencies.mutex.Unlock()
+
+	result := make(map[string]Latency, len(latencies.m))
+	for operation, latency := range latencies.m {
+		result[operation] = latency
+	}
+	return result
+}
+
+// registerLatency times every statement by wrapping the gorm callbacks of
+// each operation.
+func registerLatency(db *gorm.DB) error {
+	const key = "latency:start"
+
+	start := func(tx *gorm.DB) {
+		tx.InstanceSet(key, time.Now())
+	}
+	stop := func(operation string) func(tx *gorm.DB) {
+		return func(tx *gorm.DB) {
+			value, ok := tx.InstanceGet(key)
+			if !ok {
+				return
+			}
+			elapsed := time.Since(value.(time.Time))
+
+			latencies.mutex.Lock()
+			defer latencies.mutex.Unlock()
+			latency := latencies.m[operation]
+			latency.Count++
+			latency.Seconds += elapsed.Seconds()
+			latencies.m[operation] = latency
+		}
+	}
+
+	callback := db.Callback()
+
+	for _, err := range []error{
+		callback.Create().Before("gorm:create").Register("latency:create_start", start),
+		callback.Create().After("gorm:create").Register("latency:create_stop", stop("create")),
+		callback.Query().Before("gorm:query").Register("latency:query_start", start),
+		callback.Query().After("gorm:query").Register("latency:query_stop", stop("query")),
+		callback.Update().Before("gorm:update").Register("latency:update_start", start),
+		callback.Update().After("gorm:update").Register("latency:update_stop", stop("update")),
+		callback.Delete().Before("gorm:delete").Register("latency:delete_start", start),
+		callback.Delete().After("gorm:delete").Register("latency:delete_stop", stop("delete")),
+		callback.Row().Before("gorm:row").Register("latency:row_start", start),
+		callback.Row().After("gorm:row").Register("latency:row_stop", stop("row")),
+		callback.Raw().Before("gorm:raw").Register("latency:raw_start", start),
+		callback.Raw().After("gorm:raw").Register("latency:raw_stop", stop("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
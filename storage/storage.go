@@ -1,38 +1,104 @@
 package storage
 
 import (
+	"crypto/rand"
+	"errors"
+	"io/fs"
 	"os"
 
 	"github.com/glebarez/sqlite"
-	"github.com/lanthora/cucurbita/logger"
 	"gorm.io/gorm"
 	gormlogger "gorm.io/gorm/logger"
 )
 
 var db *gorm.DB
 
-func init() {
-	path := "/var/lib/cucurbita/"
-	err := os.MkdirAll(path, os.ModeDir)
-	if err != nil {
-		logger.Fatal(err)
+// secret is kept next to the database but not in it, so that a copy of the
+// database alone does not reveal the keys derived from it.
+var secret = make([]byte, 32)
+
+// prepares create and migrate the tables of the packages using storage, in
+// the order they were registered.
+var prepares []func() error
+
+// OnOpen registers a function that prepares the tables of a package. It runs
+// when the database is opened.
+func OnOpen(prepare func() error) {
+	prepares = append(prepares, prepare)
+}
+
+// Open opens the database at dsn and prepares its tables. An empty dsn opens
+// the database of the server under /var/lib/cucurbita along with its secret;
+// any other database gets a random secret.
+func Open(dsn string) error {
+	if dsn == "" {
+		path := "/var/lib/cucurbita/"
+		if err := os.MkdirAll(path, os.ModeDir); err != nil {
+			return err
+		}
+		if err := loadSecret(path + "secret"); err != nil {
+			return err
+		}
+		dsn = path + "sqlite.db"
+	} else if _, err := rand.Read(secret); err != nil {
+		return err
 	}
-	db, err = gorm.Open(sqlite.Open(path+"sqlite.db"), &gorm.Config{
+
+	var err error
+	db, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{
 		Logger: gormlogger.Default.LogMode(gormlogger.Silent),
 	})
 	if err != nil {
-		logger.Fatal(err)
+		return err
+	}
+
+	if err := registerLatency(db); err != nil {
+		return err
 	}
 
 	if err := AutoMigrate(Config{}); err != nil {
-		logger.Fatal(err)
+		return err
+	}
+	for _, prepare := range prepares {
+		if err := prepare(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadSecret(name string) error {
+	buffer, err := os.ReadFile(name)
+	if err == nil && len(buffer) == len(secret) {
+		copy(secret, buffer)
+		return nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		return errors.New("invalid secret: " + name)
 	}
+
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	return os.WriteFile(name, secret, 0600)
+}
+
+// Secret returns the random secret of this server.
+func Secret() []byte {
+	return secret
 }
 
 func AutoMigrate(dst ...interface{}) error {
 	return db.AutoMigrate(dst...)
 }
 
+func Migrator() gorm.Migrator {
+	return db.Migrator()
+}
+
 func Create(value interface{}) (tx *gorm.DB) {
 	return db.Create(value)
 }
@@ -61,6 +127,10 @@ func Find(dest interface{}, conds ...interface{}) (tx *gorm.DB) {
 	return db.Find(dest, conds...)
 }
 
+func Transaction(fc func(tx *gorm.DB) error) error {
+	return db.Transaction(fc)
+}
+
 type Config struct {
 	Key   string `gorm:"primaryKey"`
 	Value string
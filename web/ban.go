@@ -0,0 +1,44 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/foolin/goview"
+	"github.com/gin-gonic/gin"
+	"github.com/lanthora/cucurbita/candy"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func BanPage(c *gin.Context) {
+	var bans []candy.Ban
+	storage.Model(&candy.Ban{}).Order("created_at desc").Find(&bans)
+
+	c.HTML(http.StatusOK, "ban.html", goview.M{
+		"bans": bans,
+	})
+}
+
+func InsertBanPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "ban/insert.html", goview.M{
+		"domain": c.Query("domain"),
+		"vmac":   c.Query("vmac"),
+	})
+}
+
+func InsertBan(c *gin.Context) {
+	domain, vmac := c.PostForm("domain"), c.PostForm("vmac")
+	hours, _ := strconv.Atoi(c.PostForm("hours"))
+	if candy.BanDevice(domain, vmac, time.Duration(hours)*time.Hour) != nil {
+		c.Redirect(http.StatusSeeOther, "/ban/insert?domain="+url.QueryEscape(domain)+"&vmac="+url.QueryEscape(vmac))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/ban")
+}
+
+func DeleteBan(c *gin.Context) {
+	candy.UnbanDevice(c.Query("domain"), c.Query("vmac"))
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
@@ -0,0 +1,49 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/foolin/goview"
+	"github.com/gin-gonic/gin"
+	"github.com/lanthora/cucurbita/candy"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func BridgePage(c *gin.Context) {
+	var bridges []candy.Bridge
+	storage.Find(&bridges)
+
+	c.HTML(http.StatusOK, "bridge.html", goview.M{
+		"bridges": bridges,
+	})
+}
+
+func InsertBridgePage(c *gin.Context) {
+	c.HTML(http.StatusOK, "bridge/insert.html", nil)
+}
+
+func InsertBridge(c *gin.Context) {
+	bridge := &candy.Bridge{
+		Domain:    c.PostForm("domain"),
+		Peer:      c.PostForm("peer"),
+		DomainMap: c.PostForm("domainmap"),
+		PeerMap:   c.PostForm("peermap"),
+	}
+
+	if candy.CheckBridge(bridge) != nil || storage.Create(bridge).Error != nil {
+		c.Redirect(http.StatusSeeOther, "/bridge/insert")
+		return
+	}
+
+	candy.ReloadBridges(bridge.Domain, bridge.Peer)
+	c.Redirect(http.StatusSeeOther, "/bridge")
+}
+
+func DeleteBridge(c *gin.Context) {
+	bridge := &candy.Bridge{}
+	if result := storage.Where("id = ?", c.Query("id")).Take(bridge); result.Error == nil {
+		storage.Delete(bridge)
+		candy.ReloadBridges(bridge.Domain, bridge.Peer)
+	}
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
@@ -0,0 +1,66 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/foolin/goview"
+	"github.com/gin-gonic/gin"
+	"github.com/lanthora/cucurbita/candy"
+)
+
+func CapturePage(c *gin.Context) {
+	renderCapture(c, http.StatusOK, c.Query("domain"), c.Query("vmac"), nil)
+}
+
+func renderCapture(c *gin.Context, code int, domain, vmac string, err error) {
+	m := goview.M{
+		"domain": domain,
+		"vmac":   vmac,
+	}
+	if err != nil {
+		m["error"] = err.Error()
+	}
+	if status, ok := candy.GetCaptureStatus(domain); ok {
+		m["capture"] = status
+		m["size"] = formatRxTx(uint64(status.Size))
+	}
+	c.HTML(code, "capture.html", m)
+}
+
+func StartCapture(c *gin.Context) {
+	domain, vmac := c.PostForm("domain"), c.PostForm("vmac")
+	seconds, _ := strconv.ParseInt(c.PostForm("duration"), 10, 64)
+	if err := candy.StartCapture(domain, vmac, time.Duration(seconds)*time.Second); err != nil {
+		renderCapture(c, http.StatusBadRequest, domain, vmac, err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/capture?domain="+url.QueryEscape(domain)+"&vmac="+url.QueryEscape(vmac))
+}
+
+func StopCapture(c *gin.Context) {
+	candy.StopCapture(c.Query("domain"))
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
+
+func DeleteCapture(c *gin.Context) {
+	candy.DeleteCapture(c.Query("domain"))
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
+
+// DownloadCapture serves the capture of a domain as a pcapng file.
+func DownloadCapture(c *gin.Context) {
+	domain := c.Query("domain")
+	if _, ok := candy.GetCaptureStatus(domain); !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	filename := domain + "-" + time.Now().Format("20060102150405") + ".pcapng"
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", "attachment; filename=\""+url.PathEscape(filename)+"\"")
+	c.Status(http.StatusOK)
+	candy.WriteCapture(domain, c.Writer)
+}
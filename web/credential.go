@@ -0,0 +1,63 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/foolin/goview"
+	"github.com/gin-gonic/gin"
+	"github.com/lanthora/cucurbita/candy"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func CredentialPage(c *gin.Context) {
+	domain := &candy.Domain{}
+	storage.Where("name = ?", c.Query("domain")).Take(domain)
+
+	var credentials []candy.Credential
+	storage.Where(&candy.Credential{Domain: c.Query("domain")}).Order("created_at").Find(&credentials)
+
+	c.HTML(http.StatusOK, "credential.html", goview.M{
+		"domain":      c.Query("domain"),
+		"keyOnly":     domain.KeyOnly,
+		"credentials": credentials,
+	})
+}
+
+func InsertCredentialPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "credential/insert.html", goview.M{
+		"domain": c.Query("domain"),
+		"vmac":   c.Query("vmac"),
+	})
+}
+
+// InsertCredential shows the issued key on the insert page, since only its hash
+// is stored.
+func InsertCredential(c *gin.Context) {
+	domain, vmac := c.PostForm("domain"), c.PostForm("vmac")
+	key, err := candy.IssueCredential(domain, vmac)
+	if err != nil {
+		c.Redirect(http.StatusSeeOther, "/credential/insert?domain="+url.QueryEscape(domain))
+		return
+	}
+	c.HTML(http.StatusOK, "credential/insert.html", goview.M{
+		"domain": domain,
+		"vmac":   vmac,
+		"key":    key,
+	})
+}
+
+func DeleteCredential(c *gin.Context) {
+	candy.RevokeCredential(c.Query("domain"), c.Query("vmac"))
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
+
+func RemoveCredential(c *gin.Context) {
+	candy.RemoveCredential(c.Query("domain"), c.Query("vmac"))
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
+
+func UpdateKeyOnly(c *gin.Context) {
+	candy.UpdateKeyOnly(c.Query("domain"), c.Query("enable") == "true")
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/foolin/goview"
@@ -27,6 +29,10 @@ func DevicePage(c *gin.Context) {
 		storage.Model(&candy.Device{}).Where("online = true").Or("conn_updated_at > ?", time.Now().AddDate(0, 0, -1)).Find(&devices)
 	case "weekly":
 		storage.Model(&candy.Device{}).Where("online = true").Or("conn_updated_at > ?", time.Now().AddDate(0, 0, -7)).Find(&devices)
+	case "pending":
+		storage.Model(&candy.Device{}).Where("status = ?", candy.PENDING).Find(&devices)
+	case "outdated":
+		storage.Model(&candy.Device{}).Where("outdated = true").Find(&devices)
 	case "dormant":
 		storage.Model(&candy.Device{}).Where("online = false AND conn_updated_at < ?", time.Now().AddDate(0, 0, -7)).Find(&devices)
 	default:
@@ -43,21 +49,175 @@ func DevicePage(c *gin.Context) {
 	})
 
 	c.HTML(http.StatusOK, "device.html", goview.M{
-		"devices": devices,
-		"formatRxTx": func(n uint64) string {
-			size := float64(n)
-			units := []string{"B", "KB", "MB", "GB", "TB", "EB", "PB"}
-			idx := 0
-			for size > 1024 {
-				size = size / 1024
-				idx++
+		"devices":     devices,
+		"formatRxTx":  formatRxTx,
+		"formatRate":  formatRate,
+		"formatQuota": formatQuota,
+	})
+}
+
+func formatRxTx(n uint64) string {
+	size := float64(n)
+	units := []string{"B", "KB", "MB", "GB", "TB", "EB", "PB"}
+	idx := 0
+	for size > 1024 {
+		size = size / 1024
+		idx++
+	}
+	return fmt.Sprintf("%.2f %v", size, units[idx])
+}
+
+func formatQuota(n uint64) string {
+	if n == 0 {
+		return "-"
+	}
+	return formatRxTx(n)
+}
+
+func formatRate(n uint64) string {
+	if n == 0 {
+		return "-"
+	}
+	return formatRxTx(n) + "/s"
+}
+
+func DeviceRatePage(c *gin.Context) {
+	device := &candy.Device{Domain: c.Query("domain"), VMac: c.Query("vmac")}
+	storage.Find(device)
+
+	c.HTML(http.StatusOK, "device/rate.html", goview.M{
+		"device": device,
+		"rate":   device.Rate / 1024,
+	})
+}
+
+func UpdateDeviceRate(c *gin.Context) {
+	domain, vmac := c.PostForm("domain"), c.PostForm("vmac")
+	rate, _ := strconv.ParseUint(c.PostForm("rate"), 10, 64)
+	if candy.UpdateDeviceRate(domain, vmac, rate*1024) != nil {
+		c.Redirect(http.StatusSeeOther, "/device/rate?domain="+url.QueryEscape(domain)+"&vmac="+url.QueryEscape(vmac))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/device")
+}
+
+func DeviceQuotaPage(c *gin.Context) {
+	device := &candy.Device{Domain: c.Query("domain"), VMac: c.Query("vmac")}
+	storage.Find(device)
+
+	c.HTML(http.StatusOK, "device/quota.html", goview.M{
+		"device": device,
+		"quota":  device.Quota >> 30,
+	})
+}
+
+func UpdateDeviceQuota(c *gin.Context) {
+	domain, vmac := c.PostForm("domain"), c.PostForm("vmac")
+	quota, _ := strconv.ParseUint(c.PostForm("quota"), 10, 64)
+	if candy.UpdateDeviceQuota(domain, vmac, quota<<30) != nil {
+		c.Redirect(http.StatusSeeOther, "/device/quota?domain="+url.QueryEscape(domain)+"&vmac="+url.QueryEscape(vmac))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/device")
+}
+
+func UsagePage(c *gin.Context) {
+	var usages []candy.Usage
+	storage.Where(&candy.Usage{Domain: c.Query("domain"), VMac: c.Query("vmac")}).Order("started_at desc").Find(&usages)
+
+	c.HTML(http.StatusOK, "usage.html", goview.M{
+		"usages":     usages,
+		"formatRxTx": formatRxTx,
+	})
+}
+
+// sessionReasons are the labels of the reasons a session ended.
+var sessionReasons = map[string]string{
+	candy.CLOSED:   "客户端断开",
+	candy.TIMEOUT:  "超时",
+	candy.REPLACED: "被新连接替换",
+	candy.KICKED:   "管理员断开",
+	candy.STUCK:    "发送阻塞",
+	candy.REPLAY:   "重放消息",
+	candy.INVALID:  "无效消息",
+	candy.STOPPED:  "服务停止",
+
+	candy.RejectionName(candy.UNAUTHORIZED): "认证失败",
+	candy.RejectionName(candy.CLOCKSKEW):    "时间偏差",
+	candy.RejectionName(candy.OUTDATED):     "版本过旧",
+	candy.RejectionName(candy.BANNED):       "已封禁",
+	candy.RejectionName(candy.REFUSED):      "已拒绝",
+	candy.RejectionName(candy.EXHAUSTED):    "地址耗尽",
+	candy.RejectionName(candy.OVERQUOTA):    "超出配额",
+}
+
+// DeviceDetailPage shows a device and its sessions, all of them or those of
+// one day.
+func DeviceDetailPage(c *gin.Context) {
+	candy.Sync()
+
+	domain, vmac := c.Query("domain"), c.Query("vmac")
+	device := &candy.Device{Domain: domain, VMac: vmac}
+	storage.Find(device)
+
+	query := storage.Where(&candy.Session{Domain: domain, VMac: vmac})
+	if date, err := time.ParseInLocation(time.DateOnly, c.Query("date"), time.Local); err == nil {
+		query = query.Where("started_at < ? AND (ended_at >= ? OR reason = ?)", date.AddDate(0, 0, 1), date, "")
+	}
+	var sessions []candy.Session
+	query.Order("started_at desc").Limit(200).Find(&sessions)
+
+	c.HTML(http.StatusOK, "device/detail.html", goview.M{
+		"device":     device,
+		"sessions":   sessions,
+		"date":       c.Query("date"),
+		"formatRxTx": formatRxTx,
+		"reason": func(session candy.Session) string {
+			if session.Reason == "" {
+				return "在线"
+			}
+			if label, ok := sessionReasons[session.Reason]; ok {
+				return label
+			}
+			return session.Reason
+		},
+		"duration": func(session candy.Session) string {
+			end := session.EndedAt
+			if session.Reason == "" {
+				end = time.Now()
+			} else if end.IsZero() {
+				return "-"
 			}
-			return fmt.Sprintf("%.2f %v", size, units[idx])
+			return end.Sub(session.StartedAt).Truncate(time.Second).String()
 		},
 	})
 }
 
+func StormPage(c *gin.Context) {
+	var storms []candy.Storm
+	storage.Where(&candy.Storm{Domain: c.Query("domain"), VMac: c.Query("vmac")}).Order("started_at desc").Find(&storms)
+
+	c.HTML(http.StatusOK, "storm.html", goview.M{
+		"storms": storms,
+	})
+}
+
+func ApproveDevice(c *gin.Context) {
+	candy.UpdateDeviceStatus(c.Query("domain"), c.Query("vmac"), "")
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
+
+func DenyDevice(c *gin.Context) {
+	candy.UpdateDeviceStatus(c.Query("domain"), c.Query("vmac"), candy.DENIED)
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
+
+func DisconnectDevice(c *gin.Context) {
+	candy.DisconnectDevice(c.Query("domain"), c.Query("vmac"))
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
+
 func DeleteDevice(c *gin.Context) {
-	storage.Delete(&candy.Device{Domain: c.Query("domain"), VMac: c.Query("vmac")})
+	candy.DeleteDevice(c.Query("domain"), c.Query("vmac"))
 	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
 }
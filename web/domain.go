@@ -1,7 +1,11 @@
 package web
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 
 	"github.com/foolin/goview"
 	"github.com/gin-gonic/gin"
@@ -15,6 +19,16 @@ func DomainPage(c *gin.Context) {
 
 	c.HTML(http.StatusOK, "domain.html", goview.M{
 		"domains": domains,
+		"exit":    candy.ActiveExitNode,
+		"rate":    formatRate,
+		"quota":   formatQuota,
+		"usage": func(name string) string {
+			used, total := candy.AddressUsage(name)
+			if total == 0 {
+				return "-"
+			}
+			return fmt.Sprintf("%v/%v", used, total)
+		},
 	})
 }
 
@@ -23,7 +37,8 @@ func InsertDomainPage(c *gin.Context) {
 }
 
 func InsertDomain(c *gin.Context) {
-	result := storage.Create(&candy.Domain{Name: c.PostForm("name"), Password: c.PostForm("password"), DHCP: c.PostForm("dhcp"), Broadcast: c.PostForm("broadcast") == "enable"})
+	skew, _ := strconv.ParseInt(c.PostForm("skew"), 10, 64)
+	result := storage.Create(&candy.Domain{Name: c.PostForm("name"), Password: c.PostForm("password"), DHCP: c.PostForm("dhcp"), DHCP6: c.PostForm("dhcp6"), Broadcast: c.PostForm("broadcast") == "enable", Strategy: c.PostForm("strategy"), Skew: skew})
 	if result.Error != nil {
 		c.Redirect(http.StatusSeeOther, "/domain/insert")
 	} else {
@@ -31,6 +46,179 @@ func InsertDomain(c *gin.Context) {
 	}
 }
 
+func ExitNodePage(c *gin.Context) {
+	domain := &candy.Domain{}
+	storage.Where("name = ?", c.Query("name")).Take(domain)
+
+	c.HTML(http.StatusOK, "domain/exit.html", goview.M{
+		"domain": domain,
+	})
+}
+
+func UpdateExitNode(c *gin.Context) {
+	name := c.PostForm("name")
+	if candy.UpdateExitNode(name, c.PostForm("primary"), c.PostForm("backup")) != nil {
+		c.Redirect(http.StatusSeeOther, "/domain/exit?name="+url.QueryEscape(name))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/domain")
+}
+
+func SkewPage(c *gin.Context) {
+	domain := &candy.Domain{}
+	storage.Where("name = ?", c.Query("name")).Take(domain)
+
+	c.HTML(http.StatusOK, "domain/skew.html", goview.M{
+		"domain": domain,
+	})
+}
+
+func UpdateSkew(c *gin.Context) {
+	name := c.PostForm("name")
+	skew, _ := strconv.ParseInt(c.PostForm("skew"), 10, 64)
+	if candy.UpdateSkew(name, skew) != nil {
+		c.Redirect(http.StatusSeeOther, "/domain/skew?name="+url.QueryEscape(name))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/domain")
+}
+
+func DomainRatePage(c *gin.Context) {
+	domain := &candy.Domain{}
+	storage.Where("name = ?", c.Query("name")).Take(domain)
+
+	c.HTML(http.StatusOK, "domain/rate.html", goview.M{
+		"domain":     domain,
+		"deviceRate": domain.DeviceRate / 1024,
+		"domainRate": domain.DomainRate / 1024,
+		"broadcast":  domain.BroadcastRate / 1024,
+	})
+}
+
+func UpdateDomainRate(c *gin.Context) {
+	name := c.PostForm("name")
+	deviceRate, _ := strconv.ParseUint(c.PostForm("device"), 10, 64)
+	domainRate, _ := strconv.ParseUint(c.PostForm("domain"), 10, 64)
+	broadcastRate, _ := strconv.ParseUint(c.PostForm("broadcast"), 10, 64)
+	if candy.UpdateDomainRate(name, deviceRate*1024, domainRate*1024, broadcastRate*1024) != nil {
+		c.Redirect(http.StatusSeeOther, "/domain/rate?name="+url.QueryEscape(name))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/domain")
+}
+
+func DomainQuotaPage(c *gin.Context) {
+	domain := &candy.Domain{}
+	storage.Where("name = ?", c.Query("name")).Take(domain)
+
+	c.HTML(http.StatusOK, "domain/quota.html", goview.M{
+		"domain":      domain,
+		"deviceQuota": domain.DeviceQuota >> 30,
+		"domainQuota": domain.DomainQuota >> 30,
+	})
+}
+
+func UpdateDomainQuota(c *gin.Context) {
+	name := c.PostForm("name")
+	deviceQuota, _ := strconv.ParseUint(c.PostForm("device"), 10, 64)
+	domainQuota, _ := strconv.ParseUint(c.PostForm("domain"), 10, 64)
+	period, _ := strconv.Atoi(c.PostForm("period"))
+	if candy.UpdateDomainQuota(name, deviceQuota<<30, domainQuota<<30, period, c.PostForm("action")) != nil {
+		c.Redirect(http.StatusSeeOther, "/domain/quota?name="+url.QueryEscape(name))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/domain")
+}
+
+// VersionPage edits the version policy of a domain, or the global default
+// when no domain is named.
+func VersionPage(c *gin.Context) {
+	name := c.Query("name")
+	min, blocked := candy.DefaultVersionPolicy()
+	if name != "" {
+		domain := &candy.Domain{}
+		storage.Where("name = ?", name).Take(domain)
+		min, blocked = domain.MinVersion, domain.BlockedVersion
+	}
+
+	c.HTML(http.StatusOK, "domain/version.html", goview.M{
+		"name":    name,
+		"min":     min,
+		"blocked": blocked,
+	})
+}
+
+func UpdateVersion(c *gin.Context) {
+	name := c.PostForm("name")
+	var err error
+	if name == "" {
+		err = candy.UpdateDefaultVersionPolicy(c.PostForm("min"), c.PostForm("blocked"))
+	} else {
+		err = candy.UpdateVersionPolicy(name, c.PostForm("min"), c.PostForm("blocked"))
+	}
+	if err != nil {
+		c.Redirect(http.StatusSeeOther, "/domain/version?name="+url.QueryEscape(name))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/domain")
+}
+
+func MirrorPage(c *gin.Context) {
+	domain := &candy.Domain{}
+	storage.Where("name = ?", c.Query("name")).Take(domain)
+
+	c.HTML(http.StatusOK, "domain/mirror.html", goview.M{
+		"domain": domain,
+		"rate":   domain.MirrorRate / 1024,
+	})
+}
+
+func UpdateMirror(c *gin.Context) {
+	name := c.PostForm("name")
+	rate, _ := strconv.ParseUint(c.PostForm("rate"), 10, 64)
+	if candy.UpdateMirror(name, c.PostForm("monitor"), c.PostForm("devices"), rate*1024) != nil {
+		c.Redirect(http.StatusSeeOther, "/domain/mirror?name="+url.QueryEscape(name))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/domain")
+}
+
+// MulticastPage edits the groups a domain floods to every device and lists
+// the groups its devices joined.
+func MulticastPage(c *gin.Context) {
+	domain := &candy.Domain{}
+	storage.Where("name = ?", c.Query("name")).Take(domain)
+
+	type group struct {
+		Group string
+		Count int
+	}
+	var groups []group
+	for g, count := range candy.MulticastGroups(domain.Name) {
+		groups = append(groups, group{Group: g, Count: count})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Group < groups[j].Group })
+
+	c.HTML(http.StatusOK, "domain/multicast.html", goview.M{
+		"domain": domain,
+		"groups": groups,
+	})
+}
+
+func UpdateMulticast(c *gin.Context) {
+	name := c.PostForm("name")
+	if candy.UpdateFloodGroups(name, c.PostForm("groups")) != nil {
+		c.Redirect(http.StatusSeeOther, "/domain/multicast?name="+url.QueryEscape(name))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/domain")
+}
+
+func UpdateApproval(c *gin.Context) {
+	candy.UpdateApproval(c.Query("name"), c.Query("enable") == "true")
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
+
 func DeleteDomain(c *gin.Context) {
 	candy.DeleteDomain(c.Query("name"))
 	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
@@ -11,6 +11,8 @@ import (
 )
 
 func Index(c *gin.Context) {
+	candy.Sync()
+
 	var domains []candy.Device
 	storage.Find(&domains)
 
@@ -18,17 +20,30 @@ func Index(c *gin.Context) {
 	daily := int64(0)
 	weekly := int64(0)
 	domain := int64(0)
+	pending := int64(0)
+	outdated := int64(0)
+	storms := int64(0)
 
 	storage.Model(&candy.Device{}).Where("online = true").Count(&online)
 	storage.Model(&candy.Device{}).Where("online = true").Or("conn_updated_at > ?", time.Now().AddDate(0, 0, -1)).Count(&daily)
 	storage.Model(&candy.Device{}).Where("online = true").Or("conn_updated_at > ?", time.Now().AddDate(0, 0, -7)).Count(&weekly)
 	storage.Model(&candy.Domain{}).Count(&domain)
+	storage.Model(&candy.Device{}).Where("status = ?", candy.PENDING).Count(&pending)
+	storage.Model(&candy.Device{}).Where("outdated = true").Count(&outdated)
+	storage.Model(&candy.Storm{}).Where("started_at > ?", time.Now().AddDate(0, 0, -1)).Count(&storms)
+
+	metrics := &storage.Config{Key: "metrics_token"}
+	storage.Where(metrics).Take(metrics)
 
 	c.HTML(http.StatusOK, "index.html", goview.M{
-		"online": online,
-		"daily":  daily,
-		"weekly": weekly,
-		"domain": domain,
+		"online":   online,
+		"daily":    daily,
+		"weekly":   weekly,
+		"domain":   domain,
+		"pending":  pending,
+		"outdated": outdated,
+		"storms":   storms,
+		"metrics":  metrics.Value != "",
 	})
 }
 
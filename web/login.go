@@ -15,7 +15,7 @@ import (
 func LoginMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		route := c.Request.URL.String()
-		if route == "/login" || route == "/favicon.ico" {
+		if route == "/login" || route == "/favicon.ico" || c.Request.URL.Path == "/metrics" {
 			c.Next()
 			return
 		}
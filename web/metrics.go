@@ -0,0 +1,53 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/foolin/goview"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lanthora/cucurbita/candy"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+// Metrics serves the Prometheus endpoint. It is reachable without the admin
+// cookie but requires the metrics token as a bearer token, and is disabled
+// until a token has been generated.
+func Metrics(c *gin.Context) {
+	config := &storage.Config{Key: "metrics_token"}
+	if result := storage.Where(config).Take(config); result.Error != nil || config.Value == "" {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.Value)) != 1 {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	candy.WriteMetrics(c.Writer)
+}
+
+func MetricsTokenPage(c *gin.Context) {
+	config := &storage.Config{Key: "metrics_token"}
+	storage.Where(config).Take(config)
+
+	c.HTML(http.StatusOK, "metrics.html", goview.M{
+		"token": config.Value,
+	})
+}
+
+func ResetMetricsToken(c *gin.Context) {
+	storage.Save(&storage.Config{Key: "metrics_token", Value: uuid.New().String()})
+	c.Redirect(http.StatusSeeOther, "/metrics/token")
+}
+
+func DisableMetrics(c *gin.Context) {
+	storage.Delete(&storage.Config{Key: "metrics_token"})
+	c.Redirect(http.StatusSeeOther, "/metrics/token")
+}
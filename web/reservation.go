@@ -0,0 +1,54 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/foolin/goview"
+	"github.com/gin-gonic/gin"
+	"github.com/lanthora/cucurbita/candy"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func ReservationPage(c *gin.Context) {
+	var reservations []candy.Reservation
+	storage.Where(&candy.Reservation{Domain: c.Query("domain")}).Order("id").Find(&reservations)
+
+	c.HTML(http.StatusOK, "reservation.html", goview.M{
+		"domain":       c.Query("domain"),
+		"reservations": reservations,
+	})
+}
+
+func InsertReservationPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "reservation/insert.html", goview.M{
+		"domain":  c.Query("domain"),
+		"vmac":    c.Query("vmac"),
+		"address": c.Query("address"),
+	})
+}
+
+func InsertReservation(c *gin.Context) {
+	reservation := &candy.Reservation{
+		Domain:  c.PostForm("domain"),
+		VMac:    c.PostForm("vmac"),
+		Address: c.PostForm("address"),
+	}
+
+	if candy.CheckReservation(reservation) != nil || storage.Create(reservation).Error != nil {
+		c.Redirect(http.StatusSeeOther, "/reservation/insert?domain="+url.QueryEscape(reservation.Domain))
+		return
+	}
+
+	candy.ReloadReservations(reservation.Domain)
+	c.Redirect(http.StatusSeeOther, "/reservation?domain="+url.QueryEscape(reservation.Domain))
+}
+
+func DeleteReservation(c *gin.Context) {
+	reservation := &candy.Reservation{}
+	if result := storage.Where("id = ?", c.Query("id")).Take(reservation); result.Error == nil {
+		storage.Delete(reservation)
+		candy.ReloadReservations(reservation.Domain)
+	}
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
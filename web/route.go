@@ -0,0 +1,39 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/foolin/goview"
+	"github.com/gin-gonic/gin"
+	"github.com/lanthora/cucurbita/candy"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func RoutePage(c *gin.Context) {
+	var routes []candy.Route
+	storage.Where(&candy.Route{Domain: c.Query("domain")}).Order("id").Find(&routes)
+
+	c.HTML(http.StatusOK, "route.html", goview.M{
+		"domain": c.Query("domain"),
+		"routes": routes,
+	})
+}
+
+func ApproveRoute(c *gin.Context) {
+	route := &candy.Route{}
+	if result := storage.Where("id = ?", c.Query("id")).Take(route); result.Error == nil {
+		route.Approved = true
+		storage.Save(route)
+		candy.ReloadRoutes(route.Domain)
+	}
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
+
+func DeleteRoute(c *gin.Context) {
+	route := &candy.Route{}
+	if result := storage.Where("id = ?", c.Query("id")).Take(route); result.Error == nil {
+		storage.Delete(route)
+		candy.ReloadRoutes(route.Domain)
+	}
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
@@ -0,0 +1,56 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/foolin/goview"
+	"github.com/gin-gonic/gin"
+	"github.com/lanthora/cucurbita/candy"
+	"github.com/lanthora/cucurbita/storage"
+)
+
+func RulePage(c *gin.Context) {
+	var rules []candy.Rule
+	storage.Where(&candy.Rule{Domain: c.Query("domain")}).Order("priority, id").Find(&rules)
+
+	c.HTML(http.StatusOK, "rule.html", goview.M{
+		"domain": c.Query("domain"),
+		"rules":  rules,
+	})
+}
+
+func InsertRulePage(c *gin.Context) {
+	c.HTML(http.StatusOK, "rule/insert.html", goview.M{
+		"domain": c.Query("domain"),
+	})
+}
+
+func InsertRule(c *gin.Context) {
+	priority, _ := strconv.Atoi(c.PostForm("priority"))
+	rule := &candy.Rule{
+		Domain:   c.PostForm("domain"),
+		Priority: priority,
+		Src:      c.PostForm("src"),
+		Dst:      c.PostForm("dst"),
+		Allow:    c.PostForm("action") == "allow",
+	}
+
+	if candy.CheckRule(rule) != nil || storage.Create(rule).Error != nil {
+		c.Redirect(http.StatusSeeOther, "/rule/insert?domain="+url.QueryEscape(rule.Domain))
+		return
+	}
+
+	candy.ReloadRules(rule.Domain)
+	c.Redirect(http.StatusSeeOther, "/rule?domain="+url.QueryEscape(rule.Domain))
+}
+
+func DeleteRule(c *gin.Context) {
+	rule := &candy.Rule{}
+	if result := storage.Where("id = ?", c.Query("id")).Take(rule); result.Error == nil {
+		storage.Delete(rule)
+		candy.ReloadRules(rule.Domain)
+	}
+	c.Redirect(http.StatusSeeOther, c.GetHeader("Referer"))
+}
@@ -0,0 +1,96 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/foolin/goview"
+	"github.com/gin-gonic/gin"
+	"github.com/lanthora/cucurbita/candy"
+)
+
+// trafficRanges maps the range shown on the traffic page to its span and the
+// width of each bar.
+var trafficRanges = map[string]struct {
+	span   time.Duration
+	bucket time.Duration
+}{
+	"day":   {24 * time.Hour, time.Hour},
+	"week":  {7 * 24 * time.Hour, 6 * time.Hour},
+	"month": {30 * 24 * time.Hour, 24 * time.Hour},
+	"year":  {364 * 24 * time.Hour, 7 * 24 * time.Hour},
+}
+
+// trafficBar is one stacked bar of the chart, RX at the bottom and TX on top.
+type trafficBar struct {
+	X, Width      float64
+	RXY, RXHeight float64
+	TXY, TXHeight float64
+	StartedAt     time.Time
+	RX, TX        uint64
+}
+
+// Size of the SVG drawing area of the chart.
+const chartWidth, chartHeight = 1000.0, 200.0
+
+func TrafficPage(c *gin.Context) {
+	name, vmac := c.Query("domain"), c.Query("vmac")
+
+	selected := c.DefaultQuery("range", "day")
+	r, ok := trafficRanges[selected]
+	if !ok {
+		selected, r = "day", trafficRanges["day"]
+	}
+
+	// the chart ends at the end of the chosen date, or at the current bar
+	until := time.Now().Truncate(time.Hour).Add(time.Hour)
+	if r.bucket >= 24*time.Hour {
+		year, month, day := time.Now().Date()
+		until = time.Date(year, month, day+1, 0, 0, 0, 0, time.Local)
+	}
+	if date, err := time.ParseInLocation("2006-01-02", c.Query("date"), time.Local); err == nil {
+		until = date.AddDate(0, 0, 1)
+	}
+	since := until.Add(-r.span)
+
+	history := candy.TrafficHistory(name, vmac, since, until, r.bucket)
+
+	peak := uint64(0)
+	for _, t := range history {
+		if t.RX+t.TX > peak {
+			peak = t.RX + t.TX
+		}
+	}
+
+	bars := make([]trafficBar, len(history))
+	for idx, t := range history {
+		width := chartWidth / float64(len(history))
+		bars[idx] = trafficBar{X: float64(idx) * width, Width: width * 0.8, StartedAt: t.StartedAt, RX: t.RX, TX: t.TX}
+		if peak != 0 {
+			bars[idx].RXHeight = chartHeight * float64(t.RX) / float64(peak)
+			bars[idx].TXHeight = chartHeight * float64(t.TX) / float64(peak)
+		}
+		bars[idx].RXY = chartHeight - bars[idx].RXHeight
+		bars[idx].TXY = bars[idx].RXY - bars[idx].TXHeight
+	}
+
+	var top []candy.Traffic
+	if vmac == "" {
+		top = candy.TopTraffic(name, since, until)
+	}
+
+	c.HTML(http.StatusOK, "traffic.html", goview.M{
+		"domain":     name,
+		"vmac":       vmac,
+		"range":      selected,
+		"date":       c.Query("date"),
+		"since":      since,
+		"until":      until,
+		"bars":       bars,
+		"peak":       peak,
+		"top":        top,
+		"width":      chartWidth,
+		"height":     chartHeight,
+		"formatRxTx": formatRxTx,
+	})
+}